@@ -1,23 +1,83 @@
 package cmd
 
 import (
+	"cork/config"
 	"cork/utils"
 	"flag"
 	"fmt"
 	"os"
+	"sort"
 	"strings"
 
 	"github.com/juliangruber/go-intersect"
 )
 
+const (
+	// ResumeCommand continues a run from its state file.
+	ResumeCommand = "resume"
+	// PlanCommand is the same as the -dry-run flag.
+	PlanCommand = "plan"
+	// ValidateCommand checks a config file without running it.
+	ValidateCommand = "validate"
+	// SchemaCommand prints the JSON Schema of the config files.
+	SchemaCommand = "schema"
+	// RenderCommand prints the config files with their includes, templates and variables resolved.
+	RenderCommand = "render"
+	// ExplainCommand prints which steps are selected and why, without running them.
+	ExplainCommand = "explain"
+)
+
 type Options struct {
 	version         bool
+	Command         string
 	NoFastFailing   bool
 	Reference       string
 	Included        []string
 	Excluded        []string
-	Filename        string
+	Filenames       []string
 	NumParallelJobs int
+	Rehearse        bool
+	StateDir        string
+	DryRun          bool
+	Substitutions   map[string]string
+	// Vars are the variables interpolated in the configs, overriding the environment and their vars.
+	Vars map[string]string
+	// Profile is the name of the profile merged onto the configs.
+	Profile string
+	// Select is a selector expression the steps run must match, see config.ParseSelector.
+	Select string
+	// Labels is a label selector the steps run must match, see config.ParseLabelSelector.
+	Labels string
+	// Only, From and To are the names, possibly with wildcards, of the steps run, of the
+	// steps run with their downstream steps and of the steps run with their upstream steps.
+	Only []string
+	From []string
+	To   []string
+	// WithUpstream adds the steps the included steps depend on, directly or not.
+	WithUpstream bool
+	// WithDownstream adds the steps depending on the included steps, directly or not.
+	WithDownstream bool
+}
+
+// keyValues is a flag that can be repeated, each value being KEY=VALUE.
+type keyValues map[string]string
+
+func (values keyValues) String() string {
+	pairs := []string{}
+	for key, value := range values {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (values keyValues) Set(pair string) error {
+	parts := strings.SplitN(pair, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("%q isn't KEY=VALUE", pair)
+	}
+	values[parts[0]] = parts[1]
+	return nil
 }
 
 var (
@@ -25,6 +85,9 @@ var (
 	corkVersion string
 	included    string
 	excluded    string
+	only        string
+	from        string
+	to          string
 )
 
 func init() {
@@ -33,7 +96,22 @@ func init() {
 	flag.StringVar(&included, "include", "", "Types to be included")
 	flag.StringVar(&excluded, "exclude", "", "Types to be excluded")
 	flag.BoolVar(&options.NoFastFailing, "no-fast-failing", false, "No fast failing")
-	flag.IntVar(&options.NumParallelJobs, "parallel", 20, "The number of parallel jobs")
+	flag.IntVar(&options.NumParallelJobs, "parallel", 20, "The number of parallel jobs, shared by all the configs")
+	flag.BoolVar(&options.Rehearse, "rehearse", false, "Rehearse the pipeline against an in-memory fake backend")
+	flag.StringVar(&options.StateDir, "state-dir", ".cork", "Directory where the run state files are written")
+	flag.BoolVar(&options.DryRun, "dry-run", false, "Print the steps that would be triggered, wave by wave, without triggering them")
+	options.Substitutions = map[string]string{}
+	flag.Var(keyValues(options.Substitutions), "sub", "Substitution `KEY=VALUE` passed to the triggers declaring it, overriding the config (repeatable)")
+	options.Vars = map[string]string{}
+	flag.StringVar(&options.Profile, "profile", "", "Profile merged onto the configs defining profiles")
+	flag.StringVar(&options.Select, "select", "", "Selector `expression` the steps run must match, such as 'terraform && prod && !destroy'")
+	flag.StringVar(&options.Labels, "labels", "", "Label `selector` the steps run must match, such as 'env=prod,team in (payments,ledger)'")
+	flag.StringVar(&only, "only", "", "Names of the steps run, with wildcards")
+	flag.StringVar(&from, "from", "", "Names of the steps run with the steps depending on them, with wildcards")
+	flag.StringVar(&to, "to", "", "Names of the steps run with the steps they depend on, with wildcards")
+	flag.BoolVar(&options.WithUpstream, "with-upstream", false, "Also run the steps the selected steps depend on, directly or not")
+	flag.BoolVar(&options.WithDownstream, "with-downstream", false, "Also run the steps depending on the selected steps, directly or not")
+	flag.Var(keyValues(options.Vars), "var", "Variable `KEY=VALUE` interpolated as ${KEY} in the configs, overriding the environment and the vars of the configs (repeatable)")
 }
 
 func Parse() Options {
@@ -41,36 +119,88 @@ func Parse() Options {
 	flag.Usage = func() {
 		fmt.Fprintf(
 			flag.CommandLine.Output(), "Usage: %s "+
+				"[-dry-run] "+
 				"[-exclude \"<typeA,typeB,...>\"] "+
+				"[-from \"<step1,step2,...>\"] "+
 				"[-include \"<type1,type2,...>\"] "+
+				"[-labels <selector>] "+
 				"[-no-fast-failing] "+
+				"[-only \"<step1,step2,...>\"] "+
 				"[-parallel <number>] "+
+				"[-profile <name>] "+
 				"[-reference <ref>] "+
-				"<config_file>\n", os.Args[0],
+				"[-rehearse] "+
+				"[-select <expression>] "+
+				"[-state-dir <dir>] "+
+				"[-sub KEY=VALUE ...] "+
+				"[-to \"<step1,step2,...>\"] "+
+				"[-var KEY=VALUE ...] "+
+				"[-with-downstream] "+
+				"[-with-upstream] "+
+				"<config_file|dir|glob>...\n"+
+				"       %s plan [-exclude \"<typeA,typeB,...>\"] [-from \"<step1,step2,...>\"] [-include \"<type1,type2,...>\"] [-labels <selector>] [-only \"<step1,step2,...>\"] [-profile <name>] [-reference <ref>] [-select <expression>] [-sub KEY=VALUE ...] [-to \"<step1,step2,...>\"] [-var KEY=VALUE ...] [-with-downstream] [-with-upstream] <config_file|dir|glob>...\n"+
+				"       %s resume [-dry-run] [-no-fast-failing] [-parallel <number>] [-rehearse] <state_file>...\n"+
+				"       %s validate [-profile <name>] [-var KEY=VALUE ...] <config_file|dir|glob>...\n"+
+				"       %s render [-profile <name>] [-var KEY=VALUE ...] <config_file|dir|glob>...\n"+
+				"       %s explain [-exclude \"<typeA,typeB,...>\"] [-from \"<step1,step2,...>\"] [-include \"<type1,type2,...>\"] [-labels <selector>] [-only \"<step1,step2,...>\"] [-profile <name>] [-select <expression>] [-to \"<step1,step2,...>\"] [-var KEY=VALUE ...] [-with-downstream] [-with-upstream] <config_file|dir|glob>...\n"+
+				"       %s schema\n", os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0],
 		)
 		flag.PrintDefaults()
 	}
 
-	flag.Parse()
+	args := os.Args[1:]
+	if len(args) > 0 && (args[0] == ResumeCommand || args[0] == PlanCommand || args[0] == ValidateCommand || args[0] == SchemaCommand || args[0] == RenderCommand || args[0] == ExplainCommand) {
+		options.Command = args[0]
+		args = args[1:]
+	}
+	flag.CommandLine.Parse(args)
+	if options.Command == PlanCommand {
+		options.DryRun = true
+	}
 	if options.version {
 		fmt.Println(corkVersion)
 		os.Exit(0)
 	}
 
-	if condition := len(flag.Args()) != 1; condition {
+	if options.Command == SchemaCommand {
+		return options
+	}
+
+	if condition := len(flag.Args()) == 0; condition {
 		flag.Usage()
 		os.Exit(1)
 	}
-	options.Filename = flag.Arg(0)
+	filenames, err := utils.ExpandPaths(flag.Args())
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	options.Filenames = filenames
+	if options.Command != ResumeCommand {
+		options.Filenames = config.LeaveOutFragments(filenames)
+	}
+	if options.Command == ValidateCommand || options.Command == RenderCommand {
+		return options
+	}
 
 	options.Included = utils.RemoveEmptyStrings(strings.Split(included, ","))
 	options.Excluded = utils.RemoveEmptyStrings(strings.Split(excluded, ","))
+	options.Only = utils.RemoveEmptyStrings(strings.Split(only, ","))
+	options.From = utils.RemoveEmptyStrings(strings.Split(from, ","))
+	options.To = utils.RemoveEmptyStrings(strings.Split(to, ","))
 
 	if intersect := intersect.Hash(options.Included, options.Excluded); len(intersect) > 0 {
 		fmt.Printf("WARNING: The following types are included and excluded: %s\n", intersect)
 	}
+	if options.Command == ExplainCommand {
+		return options
+	}
 
-	fmt.Println("Using reference: " + options.Reference)
+	if options.Command == ResumeCommand {
+		fmt.Println("Resuming runs: " + strings.Join(options.Filenames, ", "))
+	} else {
+		fmt.Println("Using reference: " + options.Reference)
+	}
 	fmt.Printf("Fast failing: %v\n", !options.NoFastFailing)
 
 	return options
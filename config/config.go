@@ -4,30 +4,155 @@ import (
 	"cork/dag"
 	"cork/gcp"
 	"cork/utils"
-	"io/ioutil"
-	"log"
+	"errors"
+	"fmt"
+	"os"
 	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
+const (
+	// SKIPPED is the status of a step not run because a step it depends on didn't succeed.
+	SKIPPED = "SKIPPED"
+	// REJECTED is the status of a manual step the user refused to run.
+	REJECTED = "REJECTED"
+	// ERROR is the status of a step cork couldn't run or follow, e.g. a missing trigger.
+	ERROR = "ERROR"
+	// ABORTED is the status of a step whose build cork cancelled as the run was aborted.
+	ABORTED = "ABORTED"
+)
+
+// DefaultRetryableStatuses are the final build statuses retried when a retry policy doesn't list any.
+var DefaultRetryableStatuses = []string{gcp.FAILURE, gcp.TIMEOUT, gcp.INTERNAL_ERROR}
+
+// RetryPolicy tells how many times and how soon a step is triggered again when its build doesn't succeed.
+type RetryPolicy struct {
+	// MaxAttempts counts the first attempt.
+	MaxAttempts int `yaml:"max-attempts,omitempty"`
+	// Backoff is the delay before the first retry, doubled for each following retry.
+	Backoff time.Duration `yaml:"backoff,omitempty"`
+	// On lists the statuses to retry, DefaultRetryableStatuses when empty.
+	On []string `yaml:"on,omitempty"`
+}
+
+// ShouldRetry tells whether a build that ended with status after attempts attempts is retried,
+// the builds that succeeded never being retried.
+func (policy *RetryPolicy) ShouldRetry(attempts int, status string) bool {
+	if policy == nil || attempts >= policy.MaxAttempts || !utils.Contains(gcp.FailureStatuses, status) {
+		return false
+	}
+	retryableStatuses := policy.On
+	if len(retryableStatuses) == 0 {
+		retryableStatuses = DefaultRetryableStatuses
+	}
+	return utils.Contains(retryableStatuses, status)
+}
+
+// Check returns the problems of the retry policy of the step named stepName: it must allow
+// at least one attempt and only retry builds that didn't succeed.
+func (policy *RetryPolicy) Check(stepName string) []string {
+	problems := []string{}
+	if policy.MaxAttempts < 1 {
+		problems = append(problems, fmt.Sprintf("the retry of step %s must have max-attempts of at least 1, not %d", stepName, policy.MaxAttempts))
+	}
+	for _, status := range policy.On {
+		if !utils.Contains(gcp.FailureStatuses, status) {
+			problems = append(problems, fmt.Sprintf("the retry of step %s can't be on %s, only on %s", stepName, status, strings.Join(gcp.FailureStatuses, ", ")))
+		}
+	}
+	return problems
+}
+
+// Delay returns how long to wait before the attempt following attempts attempts.
+func (policy *RetryPolicy) Delay(attempts int) time.Duration {
+	if policy == nil || attempts < 1 {
+		return 0
+	}
+	return policy.Backoff * time.Duration(1<<(attempts-1))
+}
+
 type Config struct {
 	Author      string `yaml:"author,omitempty"`
 	ConfigFile  string `yaml:"-"`
 	Description string `yaml:"description,omitempty"`
 	Name        string `yaml:"name"`
 	Steps       []Step `yaml:"steps"`
+	// Substitutions are the defaults of the substitutions of every step.
+	Substitutions map[string]string `yaml:"substitutions,omitempty"`
+	// Region is the default region of the triggers of the steps, global when empty.
+	Region string `yaml:"region,omitempty"`
+	// Include lists the files merged under the config, relative to it, resolved by Unmarshal.
+	Include []string `yaml:"include,omitempty"`
+	// Templates are the steps extended by other steps, by name, resolved by Unmarshal.
+	Templates map[string]Step `yaml:"templates,omitempty"`
+	// Vars are the default values of the variables interpolated by Unmarshal.
+	Vars map[string]string `yaml:"vars,omitempty"`
+	// Profiles are overlays of the config by name, the one selected being merged by Unmarshal.
+	Profiles map[string]Profile `yaml:"profiles,omitempty"`
+}
+
+// Profile is an overlay merged onto a config, see Overrides.
+type Profile struct {
+	Description   string            `yaml:"description,omitempty"`
+	Region        string            `yaml:"region,omitempty"`
+	Substitutions map[string]string `yaml:"substitutions,omitempty"`
+	Vars          map[string]string `yaml:"vars,omitempty"`
+	Templates     map[string]Step   `yaml:"templates,omitempty"`
+	// Steps are merged onto the steps of the config with the same name, the others being added.
+	Steps []Step `yaml:"steps,omitempty"`
+	// Remove lists the names of the steps of the config removed by the profile.
+	Remove []string `yaml:"remove,omitempty"`
+}
+
+// Tags are written as a list or, as in earlier configs, as a string separated by commas.
+type Tags []string
+
+func (tags *Tags) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		list := ""
+		if err := value.Decode(&list); err != nil {
+			return err
+		}
+		*tags = utils.RemoveEmptyStrings(strings.Split(list, ","))
+		return nil
+	}
+	list := []string{}
+	if err := value.Decode(&list); err != nil {
+		return err
+	}
+	*tags = list
+	return nil
 }
+
 type Step struct {
-	DependsOn   []string `yaml:"depends-on,omitempty"`
-	Description string   `yaml:"description,omitempty"`
-	Manual      bool     `yaml:"manual,omitempty"`
-	Name        string   `yaml:"name,omitempty"`
-	ProjectId   string   `yaml:"project-id,omitempty"`
-	Status      string   `yaml:"status,omitempty"`
-	Tags        string   `yaml:"tags,omitempty"`
-	Trigger     string   `yaml:"trigger,omitempty"`
-	LogUrl      string   `yaml:"log-url,omitempty"`
+	DependsOn   []string      `yaml:"depends-on,omitempty"`
+	Description string        `yaml:"description,omitempty"`
+	Manual      bool          `yaml:"manual,omitempty"`
+	Name        string        `yaml:"name,omitempty"`
+	ProjectId   string        `yaml:"project-id,omitempty"`
+	Status      string        `yaml:"status,omitempty"`
+	Tags        Tags          `yaml:"tags,omitempty"`
+	Trigger     string        `yaml:"trigger,omitempty"`
+	Region      string        `yaml:"region,omitempty"`
+	LogUrl      string        `yaml:"log-url,omitempty"`
+	BuildId     string        `yaml:"build-id,omitempty"`
+	CommitSha   string        `yaml:"commit-sha,omitempty"`
+	Duration    time.Duration `yaml:"duration,omitempty"`
+	Retry       *RetryPolicy  `yaml:"retry,omitempty"`
+	Attempts    int           `yaml:"attempts,omitempty"`
+	// Substitutions are passed to the trigger, overriding the defaults of the config.
+	Substitutions map[string]string `yaml:"substitutions,omitempty"`
+	// Outputs are what the build of the step produced, referenced by the steps depending on it.
+	Outputs map[string]string `yaml:"outputs,omitempty"`
+	// Labels are matched by label selectors, see ParseLabelSelector.
+	Labels map[string]string `yaml:"labels,omitempty"`
+	// Extends is the name of the template the fields of the step override, resolved by Unmarshal.
+	Extends string `yaml:"extends,omitempty"`
+	// Matrix lists values by variable, the step being expanded by Unmarshal into a step
+	// for each combination of them.
+	Matrix map[string][]string `yaml:"matrix,omitempty"`
 }
 
 func (step Step) GetKey() string {
@@ -35,9 +160,11 @@ func (step Step) GetKey() string {
 }
 
 func (step Step) HasFinished() bool {
-	return step.Status == gcp.SUCCESS ||
-		step.Status == gcp.FAILURE ||
-		step.Status == gcp.CANCELLED
+	return gcp.IsFinal(step.Status) ||
+		step.Status == SKIPPED ||
+		step.Status == REJECTED ||
+		step.Status == ERROR ||
+		step.Status == ABORTED
 }
 
 func (step Step) IsSuccessful() bool {
@@ -48,6 +175,18 @@ func (step Step) HasStarted() bool {
 	return step.Status != ""
 }
 
+// Reset returns the step as defined in its config, without the outcome of a previous run.
+func (step Step) Reset() Step {
+	step.Status = ""
+	step.LogUrl = ""
+	step.BuildId = ""
+	step.CommitSha = ""
+	step.Duration = 0
+	step.Attempts = 0
+	step.Outputs = nil
+	return step
+}
+
 type Steps []Step
 
 func (steps Steps) Items() []dag.Task {
@@ -58,56 +197,96 @@ func (steps Steps) Items() []dag.Task {
 	return tasks
 }
 
-func shouldHandleTrigger(includedTags []string, excludedTags []string, stepTags string) bool {
-	tags := strings.Split(stepTags, ",")
-	retVal := false
-	for _, tag := range tags {
-		if (len(includedTags) == 0 ||
-			utils.MatchAtLeastOne(includedTags, tag)) &&
-			(len(excludedTags) == 0 ||
-				!utils.MatchAtLeastOne(excludedTags, tag)) {
-			retVal = true
+// GetLinks returns the dependencies between the steps of the config, leaving out the
+// dependencies on steps of the other configs run together, see SplitDependency.
+func (config Config) GetLinks(otherConfigs ...string) (links map[string][]string) {
+	links = map[string][]string{}
+	for _, task := range config.Steps {
+		for _, dependency := range task.DependsOn {
+			if configName, _ := SplitDependency(dependency, otherConfigs); configName == "" {
+				links[task.Name] = append(links[task.Name], dependency)
+			}
 		}
 	}
-	return retVal
+	return
 }
 
-func (config Config) Filter(includeTags []string, excludedTags []string) (filteredConfig Config) {
-	filteredConfig.Author = config.Author
-	filteredConfig.ConfigFile = config.ConfigFile
-	filteredConfig.Description = config.Description
-	filteredConfig.Name = config.Name
-
-	steps := []Step{}
-
-	for _, step := range config.Steps {
-		if condition := shouldHandleTrigger(includeTags, excludedTags, step.Tags); condition {
-			steps = append(steps, step)
+// GetSubstitutions returns the substitutions the trigger of step is run with: the defaults
+// of the config, overridden by those of the step, themselves overridden by overrides. The
+// defaults and the overrides only apply to the substitutions the step sets or the trigger
+// declares, declared being the substitutions of the trigger.
+func (config Config) GetSubstitutions(step Step, overrides map[string]string, declared map[string]string) map[string]string {
+	substitutions := map[string]string{}
+	for _, layer := range []map[string]string{config.Substitutions, step.Substitutions, overrides} {
+		for key, value := range layer {
+			_, isDeclared := declared[key]
+			_, isSet := step.Substitutions[key]
+			if isDeclared || isSet {
+				substitutions[key] = value
+			}
 		}
 	}
-	filteredConfig.Steps = steps
-	return
+	if len(substitutions) == 0 {
+		return nil
+	}
+	return substitutions
 }
 
-func (config Config) GetLinks() (links map[string][]string) {
-	links = map[string][]string{}
-	for _, task := range config.Steps {
-		if len(task.DependsOn) > 0 {
-			links[task.Name] = task.DependsOn
-		}
+// GetRegion returns the region of the trigger of step, defaulting to the region of the config.
+func (config Config) GetRegion(step Step) string {
+	if step.Region != "" {
+		return step.Region
 	}
-	return
+	if config.Region != "" {
+		return config.Region
+	}
+	return gcp.GlobalRegion
+}
+
+// GetTriggerKey returns the gcp.TriggerKey of the trigger of step.
+func (config Config) GetTriggerKey(step Step) string {
+	return gcp.TriggerKey(step.ProjectId, config.GetRegion(step), step.Trigger)
 }
 
-func Unmarshal(path string) Config {
+// Unmarshal reads a config file, rejecting the keys that aren't part of the config. The
+// files it includes are merged under it, the steps extending templates are resolved and
+// the profile and the variables of overrides are applied and the steps with a matrix
+// are expanded. Problems point to the file they were found in.
+func Unmarshal(path string, overrides Overrides) (Config, error) {
 	config := Config{ConfigFile: path}
-	source, err := ioutil.ReadFile(path)
-	if err != nil {
-		log.Fatal(err)
+	if _, err := os.Stat(path); err != nil {
+		return config, err
+	}
+	source, problems := loadSource(path, overrides)
+	if len(problems) > 0 {
+		messages := []string{}
+		for _, problem := range problems {
+			messages = append(messages, problem.Error())
+		}
+		return config, errors.New(strings.Join(messages, "\n"))
+	}
+	if err := source.root.Decode(&config); err != nil {
+		return config, err
+	}
+	// Invalid retry policies are refused before a run as they are by Validate.
+	messages := []string{}
+	for i, node := range stepNodes(source.root) {
+		if i < len(config.Steps) && config.Steps[i].Retry != nil {
+			for _, message := range config.Steps[i].Retry.Check(config.Steps[i].Name) {
+				messages = append(messages, source.problem(keyNode(node, "retry"), message).Error())
+			}
+		}
+	}
+	if len(messages) > 0 {
+		return config, errors.New(strings.Join(messages, "\n"))
 	}
-	err = yaml.Unmarshal(source, &config)
-	if err != nil {
-		log.Fatal(err)
+	config.Include = nil
+	config.Templates = nil
+	config.Vars = nil
+	config.Profiles = nil
+	// The templates are resolved, a config written back being read again without them.
+	for i := range config.Steps {
+		config.Steps[i].Extends = ""
 	}
-	return config
+	return config, nil
 }
@@ -1,10 +1,15 @@
 package config
 
 import (
+	"cork/gcp"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
+	"gopkg.in/yaml.v3"
 )
 
 func TestFilter(t *testing.T) {
@@ -29,13 +34,13 @@ func TestFilter(t *testing.T) {
 			steps: []Step{
 				{
 					Name: "a",
-					Tags: "example",
+					Tags: Tags{"example"},
 				},
 			},
 			expected: []Step{
 				{
 					Name: "a",
-					Tags: "example",
+					Tags: Tags{"example"},
 				},
 			},
 		},
@@ -46,7 +51,7 @@ func TestFilter(t *testing.T) {
 			steps: []Step{
 				{
 					Name: "a",
-					Tags: "example",
+					Tags: Tags{"example"},
 				},
 			},
 			expected: []Step{},
@@ -58,13 +63,13 @@ func TestFilter(t *testing.T) {
 			steps: []Step{
 				{
 					Name: "a",
-					Tags: "example",
+					Tags: Tags{"example"},
 				},
 			},
 			expected: []Step{
 				{
 					Name: "a",
-					Tags: "example",
+					Tags: Tags{"example"},
 				},
 			},
 		},
@@ -75,7 +80,7 @@ func TestFilter(t *testing.T) {
 			steps: []Step{
 				{
 					Name: "a",
-					Tags: "example",
+					Tags: Tags{"example"},
 				},
 			},
 			expected: []Step{},
@@ -87,13 +92,13 @@ func TestFilter(t *testing.T) {
 			steps: []Step{
 				{
 					Name: "a",
-					Tags: "tagB",
+					Tags: Tags{"tagB"},
 				},
 			},
 			expected: []Step{
 				{
 					Name: "a",
-					Tags: "tagB",
+					Tags: Tags{"tagB"},
 				},
 			},
 		},
@@ -101,8 +106,7 @@ func TestFilter(t *testing.T) {
 
 	for _, tc := range tcs {
 		t.Run(tc.name, func(t *testing.T) {
-			c := &Config{Steps: tc.steps}
-			got := c.Filter(tc.included, tc.excluded)
+			got := Filter([]Config{{Steps: tc.steps}}, Selection{Included: tc.included, Excluded: tc.excluded})[0]
 			if d := cmp.Diff(
 				got.Steps,
 				tc.expected,
@@ -114,3 +118,257 @@ func TestFilter(t *testing.T) {
 	}
 
 }
+
+func TestRetryPolicyShouldRetry(t *testing.T) {
+	tcs := []struct {
+		name     string
+		policy   *RetryPolicy
+		attempts int
+		status   string
+		expected bool
+	}{
+		{
+			name:     "no policy",
+			policy:   nil,
+			attempts: 1,
+			status:   gcp.FAILURE,
+			expected: false,
+		},
+		{
+			name:     "default statuses",
+			policy:   &RetryPolicy{MaxAttempts: 3},
+			attempts: 1,
+			status:   gcp.TIMEOUT,
+			expected: true,
+		},
+		{
+			name:     "cancelled not retried by default",
+			policy:   &RetryPolicy{MaxAttempts: 3},
+			attempts: 1,
+			status:   gcp.CANCELLED,
+			expected: false,
+		},
+		{
+			name:     "custom statuses",
+			policy:   &RetryPolicy{MaxAttempts: 3, On: []string{gcp.INTERNAL_ERROR}},
+			attempts: 2,
+			status:   gcp.FAILURE,
+			expected: false,
+		},
+		{
+			name:     "max attempts reached",
+			policy:   &RetryPolicy{MaxAttempts: 3},
+			attempts: 3,
+			status:   gcp.FAILURE,
+			expected: false,
+		},
+		{
+			name:     "success",
+			policy:   &RetryPolicy{MaxAttempts: 3},
+			attempts: 1,
+			status:   gcp.SUCCESS,
+			expected: false,
+		},
+		{
+			name:     "success listed",
+			policy:   &RetryPolicy{MaxAttempts: 2, On: []string{gcp.SUCCESS}},
+			attempts: 1,
+			status:   gcp.SUCCESS,
+			expected: false,
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.policy.ShouldRetry(tc.attempts, tc.status); got != tc.expected {
+				t.Errorf("got %v, want %v", got, tc.expected)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := &RetryPolicy{MaxAttempts: 4, Backoff: 10 * time.Second}
+	expected := []time.Duration{10 * time.Second, 20 * time.Second, 40 * time.Second}
+	for i, delay := range expected {
+		if got := policy.Delay(i + 1); got != delay {
+			t.Errorf("got delay %s after %d attempts, want %s", got, i+1, delay)
+		}
+	}
+}
+
+func TestUnmarshalRetryPolicy(t *testing.T) {
+	source := `
+name: test
+steps:
+  - name: a
+    retry:
+      max-attempts: 3
+      backoff: 30s
+      on: [FAILURE, TIMEOUT]
+`
+	c := Config{}
+	if err := yaml.Unmarshal([]byte(source), &c); err != nil {
+		t.Fatal(err)
+	}
+	expected := &RetryPolicy{MaxAttempts: 3, Backoff: 30 * time.Second, On: []string{gcp.FAILURE, gcp.TIMEOUT}}
+	if d := cmp.Diff(expected, c.Steps[0].Retry); d != "" {
+		t.Errorf("unexpected retry policy (-want, +got): %s", d)
+	}
+}
+
+func TestUnmarshalInvalidRetryPolicy(t *testing.T) {
+	dir := writeFiles(t, map[string]string{"cork.yaml": `name: test
+steps:
+  - name: a
+    trigger: a
+    project-id: p
+    retry:
+      max-attempts: 2
+      on: [SUCCESS]
+`})
+
+	_, err := Unmarshal(filepath.Join(dir, "cork.yaml"), Overrides{})
+	expected := "cork.yaml:6: the retry of step a can't be on SUCCESS, only on FAILURE, INTERNAL_ERROR, TIMEOUT, CANCELLED, EXPIRED"
+	if err == nil || strings.ReplaceAll(err.Error(), dir+"/", "") != expected {
+		t.Errorf("got error %v, want %s", err, expected)
+	}
+}
+
+func TestUnmarshalTagsAndLabels(t *testing.T) {
+	source := `
+name: test
+steps:
+  - name: a
+    tags: terraform, prod,
+  - name: b
+    tags: [terraform, prod]
+    labels:
+      env: prod
+      team: payments
+  - name: c
+`
+	c := Config{}
+	if err := yaml.Unmarshal([]byte(source), &c); err != nil {
+		t.Fatal(err)
+	}
+	expected := []Step{
+		{Name: "a", Tags: Tags{"terraform", "prod"}},
+		{Name: "b", Tags: Tags{"terraform", "prod"}, Labels: map[string]string{"env": "prod", "team": "payments"}},
+		{Name: "c"},
+	}
+	if d := cmp.Diff(expected, c.Steps); d != "" {
+		t.Errorf("unexpected steps (-want, +got): %s", d)
+	}
+
+	if err := yaml.Unmarshal([]byte("name: test\nsteps:\n  - name: a\n    tags: {a: b}\n"), &c); err == nil {
+		t.Error("expected an error for tags given as a mapping")
+	}
+}
+
+func TestStepHasFinished(t *testing.T) {
+	tcs := []struct {
+		status   string
+		expected bool
+	}{
+		{status: "", expected: false},
+		{status: gcp.RUNNING, expected: false},
+		{status: gcp.STATUS_UNKNOWN, expected: false},
+		{status: gcp.PENDING, expected: false},
+		{status: gcp.QUEUED, expected: false},
+		{status: gcp.WORKING, expected: false},
+		{status: gcp.SUCCESS, expected: true},
+		{status: gcp.FAILURE, expected: true},
+		{status: gcp.INTERNAL_ERROR, expected: true},
+		{status: gcp.TIMEOUT, expected: true},
+		{status: gcp.CANCELLED, expected: true},
+		{status: gcp.EXPIRED, expected: true},
+		{status: SKIPPED, expected: true},
+		{status: REJECTED, expected: true},
+		{status: ERROR, expected: true},
+		{status: ABORTED, expected: true},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.status, func(t *testing.T) {
+			step := Step{Status: tc.status}
+			if got := step.HasFinished(); got != tc.expected {
+				t.Errorf("got %v, want %v", got, tc.expected)
+			}
+		})
+	}
+}
+
+func TestGetSubstitutions(t *testing.T) {
+	tcs := []struct {
+		name      string
+		config    Config
+		step      Step
+		overrides map[string]string
+		declared  map[string]string
+		expected  map[string]string
+	}{
+		{
+			name:   "none",
+			config: Config{},
+			step:   Step{},
+		},
+		{
+			name:      "precedence",
+			config:    Config{Substitutions: map[string]string{"_ENV": "dev", "_IMAGE": "api", "_TAG": "latest"}},
+			step:      Step{Substitutions: map[string]string{"_ENV": "prod", "_TAG": "v1"}},
+			overrides: map[string]string{"_TAG": "v2"},
+			declared:  map[string]string{"_ENV": "", "_IMAGE": "", "_TAG": ""},
+			expected:  map[string]string{"_ENV": "prod", "_IMAGE": "api", "_TAG": "v2"},
+		},
+		{
+			name:      "undeclared defaults and overrides",
+			config:    Config{Substitutions: map[string]string{"_ENV": "dev", "_IMAGE": "api"}},
+			step:      Step{Substitutions: map[string]string{"_TAG": "v1"}},
+			overrides: map[string]string{"_TAG": "v2", "_IMAGE_TAG": "1.4.2"},
+			declared:  map[string]string{"_ENV": ""},
+			expected:  map[string]string{"_ENV": "dev", "_TAG": "v2"},
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			if diff := cmp.Diff(tc.expected, tc.config.GetSubstitutions(tc.step, tc.overrides, tc.declared)); diff != "" {
+				t.Errorf("unexpected substitutions (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestGetRegion(t *testing.T) {
+	tcs := []struct {
+		name     string
+		config   Config
+		step     Step
+		expected string
+	}{
+		{
+			name:     "global",
+			expected: gcp.GlobalRegion,
+		},
+		{
+			name:     "config default",
+			config:   Config{Region: "europe-west1"},
+			expected: "europe-west1",
+		},
+		{
+			name:     "step",
+			config:   Config{Region: "europe-west1"},
+			step:     Step{Region: "us-central1"},
+			expected: "us-central1",
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			if region := tc.config.GetRegion(tc.step); region != tc.expected {
+				t.Errorf("got region %s, want %s", region, tc.expected)
+			}
+		})
+	}
+}
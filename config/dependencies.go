@@ -0,0 +1,99 @@
+package config
+
+import (
+	"cork/dag"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ConfigSeparator separates the name of a config from the name of one of its steps
+// in a dependency on a step of another config, as in platform:network apply.
+const ConfigSeparator = ":"
+
+// QualifiedName identifies a step among the steps of the configs run together.
+func QualifiedName(configName string, stepName string) string {
+	return configName + ConfigSeparator + stepName
+}
+
+// SplitDependency returns the config and the step a dependency refers to, the config
+// being empty for a step of the same config. A dependency is qualified only when it
+// starts with the name of one of the other configs, so that step names may contain
+// the separator.
+func SplitDependency(dependency string, otherConfigs []string) (string, string) {
+	configName := ""
+	for _, name := range otherConfigs {
+		if strings.HasPrefix(dependency, name+ConfigSeparator) && len(name) > len(configName) {
+			configName = name
+		}
+	}
+	if configName == "" {
+		return "", dependency
+	}
+	return configName, strings.TrimPrefix(dependency, configName+ConfigSeparator)
+}
+
+// OtherConfigNames returns the names of the configs but the one named name.
+func OtherConfigNames(configs []Config, name string) []string {
+	names := []string{}
+	for _, config := range configs {
+		if config.Name != name {
+			names = append(names, config.Name)
+		}
+	}
+	return names
+}
+
+// qualifiedStep is a step keyed by its qualified name in the dag of several configs.
+type qualifiedStep struct {
+	Step
+	key string
+}
+
+func (step qualifiedStep) GetKey() string {
+	return step.key
+}
+
+type qualifiedSteps []qualifiedStep
+
+func (steps qualifiedSteps) Items() []dag.Task {
+	tasks := []dag.Task{}
+	for _, step := range steps {
+		tasks = append(tasks, dag.Task(step))
+	}
+	return tasks
+}
+
+// BuildDag builds the dag of the steps of the configs run together, keyed by their
+// qualified names, so that dependencies on undefined steps and cycles spanning
+// several configs are detected.
+func BuildDag(configs []Config) (*dag.Dag, error) {
+	files := map[string][]string{}
+	for _, config := range configs {
+		files[config.Name] = append(files[config.Name], config.ConfigFile)
+	}
+	for name, paths := range files {
+		if len(paths) > 1 {
+			sort.Strings(paths)
+			return nil, fmt.Errorf("config name %s is used by several configs: %s", name, strings.Join(paths, ", "))
+		}
+	}
+
+	steps := qualifiedSteps{}
+	links := map[string][]string{}
+	for _, config := range configs {
+		otherConfigs := OtherConfigNames(configs, config.Name)
+		for _, step := range config.Steps {
+			key := QualifiedName(config.Name, step.Name)
+			steps = append(steps, qualifiedStep{Step: step, key: key})
+			for _, dependency := range step.DependsOn {
+				configName, stepName := SplitDependency(dependency, otherConfigs)
+				if configName == "" {
+					configName = config.Name
+				}
+				links[key] = append(links[key], QualifiedName(configName, stepName))
+			}
+		}
+	}
+	return dag.BuildDag(steps, links)
+}
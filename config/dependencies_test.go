@@ -0,0 +1,77 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSplitDependency(t *testing.T) {
+	tcs := []struct {
+		name           string
+		dependency     string
+		expectedConfig string
+		expectedStep   string
+	}{
+		{
+			name:         "step of the same config",
+			dependency:   "network apply",
+			expectedStep: "network apply",
+		},
+		{
+			name:           "step of another config",
+			dependency:     "platform:network apply",
+			expectedConfig: "platform",
+			expectedStep:   "network apply",
+		},
+		{
+			name:         "separator in a step name",
+			dependency:   "db:migrate",
+			expectedStep: "db:migrate",
+		},
+		{
+			name:           "longest config name",
+			dependency:     "platform:eu:network apply",
+			expectedConfig: "platform:eu",
+			expectedStep:   "network apply",
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			configName, stepName := SplitDependency(tc.dependency, []string{"platform", "platform:eu"})
+			if configName != tc.expectedConfig || stepName != tc.expectedStep {
+				t.Errorf("got %q and %q, want %q and %q", configName, stepName, tc.expectedConfig, tc.expectedStep)
+			}
+		})
+	}
+}
+
+func TestBuildDag(t *testing.T) {
+	configs := []Config{
+		{Name: "app", Steps: []Step{
+			{Name: "build"},
+			{Name: "deploy", DependsOn: []string{"build", "platform:network apply"}},
+		}},
+		{Name: "platform", Steps: []Step{{Name: "network apply"}}},
+	}
+	d, err := BuildDag(configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := cmp.Diff([][]string{{"app:build", "platform:network apply"}, {"app:deploy"}}, d.GetWaves()); d != "" {
+		t.Errorf("unexpected waves (-want, +got): %s", d)
+	}
+	if d := cmp.Diff(map[string][]string{"deploy": {"build"}}, configs[0].GetLinks("platform")); d != "" {
+		t.Errorf("unexpected links (-want, +got): %s", d)
+	}
+
+	configs[1].Steps[0].DependsOn = []string{"app:deploy"}
+	if _, err := BuildDag(configs); err == nil {
+		t.Error("expected the cycle across configs to be detected")
+	}
+	configs[1].Name = "app"
+	if _, err := BuildDag(configs); err == nil {
+		t.Error("expected the duplicate config name to be detected")
+	}
+}
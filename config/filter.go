@@ -0,0 +1,333 @@
+package config
+
+import (
+	"cork/utils"
+	"fmt"
+	"strings"
+)
+
+// Selection tells which steps of the configs run together are run.
+type Selection struct {
+	// Included are the tags, possibly with wildcards, of the steps run, all of them when empty.
+	Included []string
+	// Excluded are the tags, possibly with wildcards, of the steps not run.
+	Excluded []string
+	// Selector selects the steps run along with the tags, all of them when nil.
+	Selector Selector
+	// Labels selects the steps run by their labels, all of them when nil, see ParseLabelSelector.
+	Labels Selector
+	// Only are the names, possibly with wildcards, of the steps run, all of them when empty.
+	Only []string
+	// From are the names, possibly with wildcards, of the steps run with the steps depending
+	// on them, directly or not, all of them when empty.
+	From []string
+	// To are the names, possibly with wildcards, of the steps run with the steps they depend
+	// on, directly or not, all of them when empty.
+	To []string
+	// WithUpstream adds the steps the selected steps depend on, directly or not.
+	WithUpstream bool
+	// WithDownstream adds the steps depending on the selected steps, directly or not.
+	WithDownstream bool
+}
+
+// stepRef is a step of one of the configs filtered together.
+type stepRef struct {
+	config int
+	name   string
+}
+
+// stepGraph links the steps of configs run together, by dependency in both directions.
+type stepGraph struct {
+	configs      []Config
+	dependencies map[stepRef][]stepRef
+	dependents   map[stepRef][]stepRef
+}
+
+func newStepGraph(configs []Config) stepGraph {
+	graph := stepGraph{
+		configs:      configs,
+		dependencies: map[stepRef][]stepRef{},
+		dependents:   map[stepRef][]stepRef{},
+	}
+	for i, config := range configs {
+		for _, step := range config.Steps {
+			ref := stepRef{config: i, name: step.Name}
+			for _, dependency := range step.DependsOn {
+				if dependencyRef, ok := graph.resolve(i, dependency); ok {
+					graph.dependencies[ref] = append(graph.dependencies[ref], dependencyRef)
+					graph.dependents[dependencyRef] = append(graph.dependents[dependencyRef], ref)
+				}
+			}
+		}
+	}
+	return graph
+}
+
+// resolve returns the step a dependency of a step of the config at index i refers to,
+// false if it is undefined.
+func (graph stepGraph) resolve(i int, dependency string) (stepRef, bool) {
+	configName, stepName := SplitDependency(dependency, OtherConfigNames(graph.configs, graph.configs[i].Name))
+	for j, config := range graph.configs {
+		if (configName == "" && j != i) || (configName != "" && config.Name != configName) {
+			continue
+		}
+		for _, step := range config.Steps {
+			if step.Name == stepName {
+				return stepRef{config: j, name: stepName}, true
+			}
+		}
+		break
+	}
+	return stepRef{}, false
+}
+
+// dependencyName returns the name of the step as written in the dependencies of the steps
+// of the config at index i.
+func (graph stepGraph) dependencyName(i int, ref stepRef) string {
+	if ref.config == i {
+		return ref.name
+	}
+	return QualifiedName(graph.configs[ref.config].Name, ref.name)
+}
+
+// step returns the step referred to.
+func (graph stepGraph) step(ref stepRef) Step {
+	for _, step := range graph.configs[ref.config].Steps {
+		if step.Name == ref.name {
+			return step
+		}
+	}
+	return Step{}
+}
+
+// reachable returns the steps linked to the steps, directly or not, along with the step
+// each of them was reached from, the steps being walked in order.
+func reachable(steps []stepRef, links map[stepRef][]stepRef) map[stepRef]stepRef {
+	reached := map[stepRef]stepRef{}
+	for _, ref := range steps {
+		pending := []stepRef{ref}
+		for len(pending) > 0 {
+			current := pending[0]
+			pending = pending[1:]
+			for _, linked := range links[current] {
+				if _, ok := reached[linked]; !ok {
+					reached[linked] = ref
+					pending = append(pending, linked)
+				}
+			}
+		}
+	}
+	return reached
+}
+
+// stepRange is the range of the steps named by one of the step options of a selection,
+// Only, From or To, along with the steps linked to them, if any.
+type stepRange struct {
+	option   string
+	patterns []string
+	// steps are the steps of the range, along with the named step each of them was reached from.
+	steps    map[stepRef]stepRef
+	relation string
+}
+
+// newStepRange returns the range of the steps matching the patterns and of the steps
+// linked to them, none when links is nil.
+func (graph stepGraph) newStepRange(option string, patterns []string, links map[stepRef][]stepRef, relation string) stepRange {
+	named := graph.matchNames(patterns)
+	steps := reachable(named, links)
+	for _, ref := range named {
+		steps[ref] = ref
+	}
+	return stepRange{option: option, patterns: patterns, steps: steps, relation: relation}
+}
+
+// contains tells whether the step is in the range, and why.
+func (r stepRange) contains(graph stepGraph, ref stepRef) (bool, string) {
+	option := r.option + " " + strings.Join(r.patterns, ",")
+	origin, ok := r.steps[ref]
+	switch {
+	case !ok && r.relation == "":
+		return false, "doesn't match " + option
+	case !ok:
+		return false, "not " + r.relation + " " + option
+	case origin == ref:
+		return true, "matches " + option
+	}
+	return true, r.relation + " " + graph.dependencyName(ref.config, origin)
+}
+
+// matchNames returns the steps whose names, or qualified names, match one of the
+// patterns, in order.
+func (graph stepGraph) matchNames(patterns []string) []stepRef {
+	refs := []stepRef{}
+	for i, config := range graph.configs {
+		for _, step := range config.Steps {
+			if utils.MatchAtLeastOne(patterns, step.Name) || utils.MatchAtLeastOne(patterns, QualifiedName(config.Name, step.Name)) {
+				refs = append(refs, stepRef{config: i, name: step.Name})
+			}
+		}
+	}
+	return refs
+}
+
+// Check returns an error if a step name of the selection matches none of the steps of
+// the configs, most likely a typo.
+func (selection Selection) Check(configs []Config) error {
+	graph := newStepGraph(configs)
+	for _, option := range []struct {
+		name     string
+		patterns []string
+	}{{"-only", selection.Only}, {"-from", selection.From}, {"-to", selection.To}} {
+		for _, pattern := range option.patterns {
+			if len(graph.matchNames([]string{pattern})) == 0 {
+				return fmt.Errorf("%s %s matches no step", option.name, pattern)
+			}
+		}
+	}
+	return nil
+}
+
+// Explanation tells whether a step is selected and why.
+type Explanation struct {
+	Config   string
+	Step     string
+	Selected bool
+	// Reasons are the facts the selection of the step depends on.
+	Reasons []string
+}
+
+// Explain tells for every step of the configs, in order, whether it is selected.
+func Explain(configs []Config, selection Selection) []Explanation {
+	graph := newStepGraph(configs)
+	explanations := graph.explain(selection)
+	ordered := []Explanation{}
+	for i, config := range configs {
+		for _, step := range config.Steps {
+			ordered = append(ordered, explanations[stepRef{config: i, name: step.Name}])
+		}
+	}
+	return ordered
+}
+
+// explain tells for every step whether it is selected and why.
+func (graph stepGraph) explain(selection Selection) map[stepRef]Explanation {
+	selector := selectorAnd{operands: []Selector{TagsSelector(selection.Included, selection.Excluded)}}
+	if selection.Selector != nil {
+		selector.operands = append(selector.operands, selection.Selector)
+	}
+	if selection.Labels != nil {
+		selector.operands = append(selector.operands, selection.Labels)
+	}
+	ranges := []stepRange{}
+	if len(selection.Only) > 0 {
+		ranges = append(ranges, graph.newStepRange("-only", selection.Only, nil, ""))
+	}
+	if len(selection.From) > 0 {
+		ranges = append(ranges, graph.newStepRange("-from", selection.From, graph.dependents, "downstream of"))
+	}
+	if len(selection.To) > 0 {
+		ranges = append(ranges, graph.newStepRange("-to", selection.To, graph.dependencies, "upstream of"))
+	}
+	explanations := map[stepRef]Explanation{}
+	matched := []stepRef{}
+	for i, config := range graph.configs {
+		for _, step := range config.Steps {
+			ref := stepRef{config: i, name: step.Name}
+			selected, reasons := selector.Match(step)
+			// The reasons of a step left out are the conditions it doesn't meet only.
+			for _, r := range ranges {
+				contained, reason := r.contains(graph, ref)
+				switch {
+				case contained && selected:
+					reasons = append(reasons, reason)
+				case !contained && selected:
+					selected = false
+					reasons = []string{reason}
+				case !contained:
+					reasons = append(reasons, reason)
+				}
+			}
+			explanations[ref] = Explanation{Config: config.Name, Step: step.Name, Selected: selected, Reasons: reasons}
+			if selected {
+				matched = append(matched, ref)
+			}
+		}
+	}
+	add := func(links map[stepRef][]stepRef, relation string) {
+		for ref, origin := range reachable(matched, links) {
+			if explanation := explanations[ref]; !explanation.Selected {
+				explanation.Selected = true
+				explanation.Reasons = []string{relation + " " + graph.dependencyName(ref.config, origin)}
+				explanations[ref] = explanation
+			}
+		}
+	}
+	if selection.WithUpstream {
+		add(graph.dependencies, "upstream of")
+	}
+	if selection.WithDownstream {
+		add(graph.dependents, "downstream of")
+	}
+	return explanations
+}
+
+// Filter returns the configs with the steps of the selection only. The dependencies of
+// the steps kept on removed steps are replaced by the dependencies of the removed steps,
+// recursively, so that the steps kept run in the same order. Dependencies on undefined
+// steps are kept for them to be reported.
+func Filter(configs []Config, selection Selection) []Config {
+	graph := newStepGraph(configs)
+	kept := map[stepRef]bool{}
+	for ref, explanation := range graph.explain(selection) {
+		kept[ref] = explanation.Selected
+	}
+
+	filteredConfigs := []Config{}
+	for i, config := range configs {
+		steps := []Step{}
+		for _, step := range config.Steps {
+			if !kept[stepRef{config: i, name: step.Name}] {
+				continue
+			}
+			dependsOn := []string{}
+			seen := map[string]bool{}
+			visited := map[stepRef]bool{}
+			// rewire adds the dependencies of a step of the config at index j, the step
+			// kept or, when removed, one of the steps it depends on.
+			var rewire func(j int, dependencies []string, removed bool)
+			rewire = func(j int, dependencies []string, removed bool) {
+				for _, dependency := range dependencies {
+					ref, ok := graph.resolve(j, dependency)
+					name := dependency
+					if ok {
+						name = graph.dependencyName(i, ref)
+					} else if removed {
+						// The undefined dependencies of removed steps don't matter.
+						continue
+					}
+					if !ok || kept[ref] {
+						if !seen[name] {
+							seen[name] = true
+							dependsOn = append(dependsOn, name)
+						}
+						continue
+					}
+					if !visited[ref] {
+						visited[ref] = true
+						rewire(ref.config, graph.step(ref).DependsOn, true)
+					}
+				}
+			}
+			rewire(i, step.DependsOn, false)
+			if len(dependsOn) == 0 {
+				dependsOn = nil
+			}
+			step.DependsOn = dependsOn
+			steps = append(steps, step)
+		}
+		filtered := config
+		filtered.Steps = steps
+		filteredConfigs = append(filteredConfigs, filtered)
+	}
+	return filteredConfigs
+}
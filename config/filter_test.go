@@ -0,0 +1,262 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// filterSteps are build -> test -> package -> deploy -> notify, with docs depending on build.
+var filterSteps = []Step{
+	{Name: "build", Tags: Tags{"build"}},
+	{Name: "test", Tags: Tags{"test"}, DependsOn: []string{"build"}},
+	{Name: "docs", Tags: Tags{"docs"}, DependsOn: []string{"build"}},
+	{Name: "package", Tags: Tags{"build"}, DependsOn: []string{"test"}},
+	{Name: "deploy", Tags: Tags{"deploy"}, DependsOn: []string{"package", "docs"}},
+	{Name: "notify", Tags: Tags{"deploy"}, DependsOn: []string{"deploy"}},
+}
+
+func TestFilterDependencies(t *testing.T) {
+	tcs := []struct {
+		name      string
+		selection Selection
+		expected  map[string][]string
+	}{
+		{
+			name:      "rewired through removed steps",
+			selection: Selection{Excluded: []string{"test", "docs"}},
+			expected: map[string][]string{
+				"build":   nil,
+				"package": {"build"},
+				"deploy":  {"package", "build"},
+				"notify":  {"deploy"},
+			},
+		},
+		{
+			name:      "removed chain",
+			selection: Selection{Included: []string{"build", "deploy"}, Excluded: []string{"build"}},
+			expected: map[string][]string{
+				"deploy": nil,
+				"notify": {"deploy"},
+			},
+		},
+		{
+			name:      "with upstream",
+			selection: Selection{Included: []string{"test"}, WithUpstream: true},
+			expected: map[string][]string{
+				"build": nil,
+				"test":  {"build"},
+			},
+		},
+		{
+			name:      "with downstream",
+			selection: Selection{Included: []string{"docs"}, WithDownstream: true},
+			expected: map[string][]string{
+				"docs":   nil,
+				"deploy": {"docs"},
+				"notify": {"deploy"},
+			},
+		},
+		{
+			name:      "with upstream and downstream",
+			selection: Selection{Included: []string{"test"}, WithUpstream: true, WithDownstream: true},
+			expected: map[string][]string{
+				"build":   nil,
+				"test":    {"build"},
+				"package": {"test"},
+				"deploy":  {"package", "build"},
+				"notify":  {"deploy"},
+			},
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			filtered := Filter([]Config{{Name: "app", Steps: filterSteps}}, tc.selection)[0]
+			got := map[string][]string{}
+			for _, step := range filtered.Steps {
+				got[step.Name] = step.DependsOn
+			}
+			if d := cmp.Diff(tc.expected, got); d != "" {
+				t.Errorf("unexpected dependencies (-want, +got): %s", d)
+			}
+		})
+	}
+}
+
+func TestFilterSeveralConfigs(t *testing.T) {
+	configs := []Config{
+		{Name: "platform", Steps: []Step{
+			{Name: "network", Tags: Tags{"infra"}},
+			{Name: "cluster", Tags: Tags{"cluster"}},
+			{Name: "nodes", Tags: Tags{"cluster"}, DependsOn: []string{"network", "cluster"}},
+		}},
+		{Name: "app", Steps: []Step{
+			{Name: "build", Tags: Tags{"app"}},
+			{Name: "deploy", Tags: Tags{"app"}, DependsOn: []string{"build", "platform:nodes"}},
+		}},
+	}
+
+	filtered := Filter(configs, Selection{Excluded: []string{"cluster"}})
+	if d := cmp.Diff([]string{"build", "platform:network"}, filtered[1].Steps[1].DependsOn); d != "" {
+		t.Errorf("unexpected dependencies of deploy (-want, +got): %s", d)
+	}
+	if _, err := BuildDag(filtered); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	filtered = Filter(configs, Selection{Included: []string{"app"}, WithUpstream: true})
+	if d := cmp.Diff([]string{"network", "cluster", "nodes"}, stepNames(filtered[0].Steps)); d != "" {
+		t.Errorf("unexpected steps of platform (-want, +got): %s", d)
+	}
+
+	configs[1].Steps[1].DependsOn = []string{"undefined"}
+	filtered = Filter(configs, Selection{Included: []string{"app"}})
+	if d := cmp.Diff([]string{"undefined"}, filtered[1].Steps[1].DependsOn); d != "" {
+		t.Errorf("unexpected dependencies of deploy (-want, +got): %s", d)
+	}
+}
+
+func stepNames(steps []Step) []string {
+	names := []string{}
+	for _, step := range steps {
+		names = append(names, step.Name)
+	}
+	return names
+}
+
+func TestExplain(t *testing.T) {
+	selector, err := ParseSelector("test || name:notify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	explanations := Explain([]Config{{Name: "app", Steps: filterSteps}}, Selection{Excluded: []string{"deploy"}, Selector: selector, WithUpstream: true})
+	expected := []Explanation{
+		{Config: "app", Step: "build", Selected: true, Reasons: []string{"upstream of test"}},
+		{Config: "app", Step: "test", Selected: true, Reasons: []string{"tag test doesn't match -exclude deploy", "tag test matches test"}},
+		{Config: "app", Step: "docs", Selected: false, Reasons: []string{"no tag matches test", `name "docs" doesn't match name:notify`}},
+		{Config: "app", Step: "package", Selected: false, Reasons: []string{"no tag matches test", `name "package" doesn't match name:notify`}},
+		{Config: "app", Step: "deploy", Selected: false, Reasons: []string{"tag deploy matches -exclude deploy"}},
+		{Config: "app", Step: "notify", Selected: false, Reasons: []string{"tag deploy matches -exclude deploy"}},
+	}
+	if d := cmp.Diff(expected, explanations); d != "" {
+		t.Errorf("unexpected explanations (-want, +got): %s", d)
+	}
+}
+
+func TestFilterStepRanges(t *testing.T) {
+	tcs := []struct {
+		name      string
+		selection Selection
+		expected  map[string][]string
+	}{
+		{
+			name:      "only",
+			selection: Selection{Only: []string{"package", "notify"}},
+			expected: map[string][]string{
+				"package": nil,
+				"notify":  {"package"},
+			},
+		},
+		{
+			name:      "only with wildcards",
+			selection: Selection{Only: []string{"d*"}},
+			expected: map[string][]string{
+				"docs":   nil,
+				"deploy": {"docs"},
+			},
+		},
+		{
+			name:      "from",
+			selection: Selection{From: []string{"package"}},
+			expected: map[string][]string{
+				"package": nil,
+				"deploy":  {"package"},
+				"notify":  {"deploy"},
+			},
+		},
+		{
+			name:      "to",
+			selection: Selection{To: []string{"package"}},
+			expected: map[string][]string{
+				"build":   nil,
+				"test":    {"build"},
+				"package": {"test"},
+			},
+		},
+		{
+			name:      "from and to",
+			selection: Selection{From: []string{"test"}, To: []string{"deploy"}},
+			expected: map[string][]string{
+				"test":    nil,
+				"package": {"test"},
+				"deploy":  {"package"},
+			},
+		},
+		{
+			name:      "qualified name",
+			selection: Selection{Only: []string{"app:build"}},
+			expected: map[string][]string{
+				"build": nil,
+			},
+		},
+		{
+			name:      "with tags",
+			selection: Selection{From: []string{"test"}, Excluded: []string{"deploy"}},
+			expected: map[string][]string{
+				"test":    nil,
+				"package": {"test"},
+			},
+		},
+		{
+			name:      "with upstream",
+			selection: Selection{Only: []string{"deploy"}, WithUpstream: true},
+			expected: map[string][]string{
+				"build":   nil,
+				"test":    {"build"},
+				"docs":    {"build"},
+				"package": {"test"},
+				"deploy":  {"package", "docs"},
+			},
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			filtered := Filter([]Config{{Name: "app", Steps: filterSteps}}, tc.selection)[0]
+			got := map[string][]string{}
+			for _, step := range filtered.Steps {
+				got[step.Name] = step.DependsOn
+			}
+			if d := cmp.Diff(tc.expected, got); d != "" {
+				t.Errorf("unexpected dependencies (-want, +got): %s", d)
+			}
+		})
+	}
+}
+
+func TestExplainStepRanges(t *testing.T) {
+	explanations := Explain([]Config{{Name: "app", Steps: filterSteps}}, Selection{From: []string{"test"}, To: []string{"dep*"}, Included: []string{"build", "deploy"}})
+	expected := []Explanation{
+		{Config: "app", Step: "build", Selected: false, Reasons: []string{"not downstream of -from test"}},
+		{Config: "app", Step: "test", Selected: false, Reasons: []string{"no tag matches -include build,deploy"}},
+		{Config: "app", Step: "docs", Selected: false, Reasons: []string{"no tag matches -include build,deploy", "not downstream of -from test"}},
+		{Config: "app", Step: "package", Selected: true, Reasons: []string{"tag build matches -include build,deploy", "downstream of test", "upstream of deploy"}},
+		{Config: "app", Step: "deploy", Selected: true, Reasons: []string{"tag deploy matches -include build,deploy", "downstream of test", "matches -to dep*"}},
+		{Config: "app", Step: "notify", Selected: false, Reasons: []string{"not upstream of -to dep*"}},
+	}
+	if d := cmp.Diff(expected, explanations); d != "" {
+		t.Errorf("unexpected explanations (-want, +got): %s", d)
+	}
+}
+
+func TestSelectionCheck(t *testing.T) {
+	configs := []Config{{Name: "app", Steps: filterSteps}}
+	if err := (Selection{Only: []string{"build"}, From: []string{"d*"}, To: []string{"app:notify"}}).Check(configs); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	err := Selection{From: []string{"test"}, To: []string{"deplyo"}}.Check(configs)
+	if err == nil || err.Error() != "-to deplyo matches no step" {
+		t.Errorf("got error %v, want -to deplyo matches no step", err)
+	}
+}
@@ -0,0 +1,325 @@
+package config
+
+import (
+	"bytes"
+	"cork/utils"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// source is a config file with the files it includes merged, its steps extending
+// templates resolved, its variables interpolated and its matrices expanded, along with
+// the file every yaml node comes from so that problems point to it.
+type source struct {
+	root    *yaml.Node
+	origins map[*yaml.Node]string
+	// files are the config file and the files it includes, in the order they were read.
+	files []string
+}
+
+// Overrides are given on the command line to resolve the configs.
+type Overrides struct {
+	// Vars override the environment and the vars of the configs.
+	Vars map[string]string
+	// Profile is the name of the profile merged onto the configs, none when empty.
+	Profile string
+}
+
+// loadSource reads the config file, merges the files it includes and the profile,
+// resolves the steps extending templates, interpolates the variables and expands the
+// matrices. It returns nil if the config file couldn't be read.
+func loadSource(path string, overrides Overrides) (*source, []Problem) {
+	s := &source{origins: map[*yaml.Node]string{}}
+	root, problems := s.load(path, nil, nil)
+	if root == nil {
+		return nil, problems
+	}
+	s.root = root
+	problems = append(problems, s.applyProfile(overrides.Profile)...)
+	problems = append(problems, s.resolveTemplates()...)
+	problems = append(problems, s.interpolate(overrides.Vars)...)
+	return s, append(problems, s.expandMatrices()...)
+}
+
+// SourceFiles returns the config file and the files it includes, directly or not.
+func SourceFiles(path string) []string {
+	s := &source{origins: map[*yaml.Node]string{}}
+	s.load(path, nil, nil)
+	if len(s.files) == 0 {
+		return []string{path}
+	}
+	return s.files
+}
+
+// LeaveOutFragments returns the config files without those included by another of them,
+// such as the fragments of a directory or a glob pattern.
+func LeaveOutFragments(paths []string) []string {
+	included := map[string]bool{}
+	for _, path := range paths {
+		for _, file := range SourceFiles(path)[1:] {
+			if absolute, err := filepath.Abs(file); err == nil {
+				included[absolute] = true
+			}
+		}
+	}
+	configs := []string{}
+	for _, path := range paths {
+		if absolute, err := filepath.Abs(path); err != nil || !included[absolute] {
+			configs = append(configs, path)
+		}
+	}
+	if len(configs) == 0 {
+		// Files including each other are all reported by Unmarshal.
+		return paths
+	}
+	return configs
+}
+
+func (s *source) problem(node *yaml.Node, message string) Problem {
+	return Problem{File: s.origins[node], Line: node.Line, Message: message}
+}
+
+// setOrigin records that the node and its children come from the file.
+func (s *source) setOrigin(node *yaml.Node, path string) {
+	s.origins[node] = path
+	for _, child := range node.Content {
+		s.setOrigin(child, path)
+	}
+}
+
+// load returns the mapping of the config file merged onto the files it includes, in
+// order. including are the files including it, and include the node naming it in the
+// last of them, nil for the config file itself.
+func (s *source) load(path string, including []string, include *yaml.Node) (*yaml.Node, []Problem) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		if include != nil {
+			return nil, []Problem{s.problem(include, "can't include "+include.Value+": "+err.Error())}
+		}
+		return nil, []Problem{{File: path, Message: err.Error()}}
+	}
+	s.files = append(s.files, path)
+	document := yaml.Node{}
+	if err := yaml.Unmarshal(content, &document); err != nil {
+		return nil, yamlProblems(path, err)
+	}
+	// Every file is decoded on its own so that unknown keys are reported in the file having them.
+	problems := []Problem{}
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&Config{}); err != nil && err != io.EOF {
+		problems = append(problems, yamlProblems(path, err)...)
+	}
+	root := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	if len(document.Content) > 0 {
+		root = document.Content[0]
+	}
+	if root.Kind != yaml.MappingNode {
+		return nil, problems
+	}
+	s.setOrigin(root, path)
+
+	chain := append(append([]string{}, including...), path)
+	merged := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	if _, includes := mappingValue(root, "include"); includes != nil && includes.Kind == yaml.SequenceNode {
+		for _, include := range includes.Content {
+			includePath := include.Value
+			if !filepath.IsAbs(includePath) {
+				includePath = filepath.Join(filepath.Dir(path), includePath)
+			}
+			if utils.Contains(chain, includePath) {
+				problems = append(problems, s.problem(include, "include cycle: "+strings.Join(append(chain, includePath), " -> ")))
+				continue
+			}
+			included, includedProblems := s.load(includePath, chain, include)
+			problems = append(problems, includedProblems...)
+			if included != nil {
+				merged = s.mergeConfigs(merged, included)
+			}
+		}
+	}
+	return s.mergeConfigs(merged, root), problems
+}
+
+// mergeConfigs returns the config mapping overlay merged onto base: the steps of overlay
+// are appended to those of base, the other keys are merged as by mergeMappings and the
+// includes, already resolved, are left out.
+func (s *source) mergeConfigs(base *yaml.Node, overlay *yaml.Node) *yaml.Node {
+	merged := s.mergeMappings(base, overlay)
+	_, baseSteps := mappingValue(base, "steps")
+	_, overlaySteps := mappingValue(overlay, "steps")
+	content := []*yaml.Node{}
+	for i := 0; i+1 < len(merged.Content); i += 2 {
+		key, value := merged.Content[i], merged.Content[i+1]
+		switch key.Value {
+		case "include":
+			continue
+		case "steps":
+			if baseSteps != nil && overlaySteps != nil && baseSteps.Kind == yaml.SequenceNode && overlaySteps.Kind == yaml.SequenceNode {
+				steps := *overlaySteps
+				steps.Content = append(append([]*yaml.Node{}, baseSteps.Content...), overlaySteps.Content...)
+				value = &steps
+				s.origins[value] = s.origins[overlaySteps]
+			}
+		}
+		content = append(content, key, value)
+	}
+	merged.Content = content
+	return merged
+}
+
+// mergeMappings returns the mapping overlay merged onto base key by key: the mappings
+// under the same key in both, such as substitutions, are merged too while the other
+// values of overlay replace those of base.
+func (s *source) mergeMappings(base *yaml.Node, overlay *yaml.Node) *yaml.Node {
+	merged := *overlay
+	merged.Content = []*yaml.Node{}
+	s.origins[&merged] = s.origins[overlay]
+	if base.Kind == yaml.MappingNode {
+		merged.Content = append(merged.Content, base.Content...)
+	}
+	for i := 0; i+1 < len(overlay.Content); i += 2 {
+		key, value := overlay.Content[i], overlay.Content[i+1]
+		replaced := false
+		for j := 0; j+1 < len(merged.Content); j += 2 {
+			if merged.Content[j].Value != key.Value {
+				continue
+			}
+			if merged.Content[j+1].Kind == yaml.MappingNode && value.Kind == yaml.MappingNode {
+				value = s.mergeMappings(merged.Content[j+1], value)
+			}
+			merged.Content[j], merged.Content[j+1] = key, value
+			replaced = true
+			break
+		}
+		if !replaced {
+			merged.Content = append(merged.Content, key, value)
+		}
+	}
+	return &merged
+}
+
+// resolveTemplates replaces every step extending a template by the template merged with the step.
+func (s *source) resolveTemplates() []Problem {
+	_, templates := mappingValue(s.root, "templates")
+	_, steps := mappingValue(s.root, "steps")
+	if steps == nil || steps.Kind != yaml.SequenceNode {
+		return nil
+	}
+	problems := []Problem{}
+	for i, step := range steps.Content {
+		resolved, stepProblems := s.extend(step, templates, nil)
+		problems = append(problems, stepProblems...)
+		if resolved != nil {
+			steps.Content[i] = resolved
+		}
+	}
+	return problems
+}
+
+// extend returns the step, or template, merged onto the template it extends, itself
+// resolved first. extending are the templates already being resolved, to detect cycles.
+func (s *source) extend(step *yaml.Node, templates *yaml.Node, extending []string) (*yaml.Node, []Problem) {
+	_, extends := mappingValue(step, "extends")
+	if extends == nil {
+		return step, nil
+	}
+	name := extends.Value
+	chain := append(append([]string{}, extending...), name)
+	if utils.Contains(extending, name) {
+		return nil, []Problem{s.problem(extends, "template cycle: "+strings.Join(chain, " -> "))}
+	}
+	_, template := mappingValue(templates, name)
+	if template == nil || template.Kind != yaml.MappingNode {
+		return nil, []Problem{s.problem(extends, "undefined template "+name)}
+	}
+	base, problems := s.extend(template, templates, chain)
+	if base == nil {
+		return nil, problems
+	}
+	return s.mergeMappings(base, step), nil
+}
+
+// applyProfile merges the profile onto the config. The steps of the profile are merged
+// onto the steps of the config with the same name, as by mergeMappings, or appended in
+// their order, the steps listed under remove are removed and the other keys are merged
+// as by mergeMappings. A config without profiles is left as it is.
+func (s *source) applyProfile(name string) []Problem {
+	profilesKey, profiles := mappingValue(s.root, "profiles")
+	if name == "" || profiles == nil {
+		return nil
+	}
+	_, profile := mappingValue(profiles, name)
+	if profile == nil || profile.Kind != yaml.MappingNode {
+		return []Problem{s.problem(profilesKey, "undefined profile "+name)}
+	}
+
+	overlay := *profile
+	overlay.Content = []*yaml.Node{}
+	for i := 0; i+1 < len(profile.Content); i += 2 {
+		if key := profile.Content[i].Value; key != "steps" && key != "remove" {
+			overlay.Content = append(overlay.Content, profile.Content[i], profile.Content[i+1])
+		}
+	}
+	merged := s.mergeMappings(s.root, &overlay)
+
+	stepsKey, steps := mappingValue(merged, "steps")
+	if steps == nil || steps.Kind != yaml.SequenceNode {
+		stepsKey = &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "steps"}
+		steps = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		merged.Content = append(merged.Content, stepsKey, steps)
+	}
+	resolved := *steps
+	resolved.Content = append([]*yaml.Node{}, steps.Content...)
+	s.origins[&resolved] = s.origins[steps]
+	if _, profileSteps := mappingValue(profile, "steps"); profileSteps != nil && profileSteps.Kind == yaml.SequenceNode {
+		for _, step := range profileSteps.Content {
+			if i := stepIndex(&resolved, step); i >= 0 {
+				resolved.Content[i] = s.mergeMappings(resolved.Content[i], step)
+			} else {
+				resolved.Content = append(resolved.Content, step)
+			}
+		}
+	}
+	problems := []Problem{}
+	if _, remove := mappingValue(profile, "remove"); remove != nil && remove.Kind == yaml.SequenceNode {
+		for _, removed := range remove.Content {
+			i := stepIndex(&resolved, removed)
+			if i < 0 {
+				problems = append(problems, s.problem(removed, "profile "+name+" removes undefined step "+removed.Value))
+				continue
+			}
+			resolved.Content = append(resolved.Content[:i], resolved.Content[i+1:]...)
+		}
+	}
+	for i := 0; i+1 < len(merged.Content); i += 2 {
+		if merged.Content[i] == stepsKey {
+			merged.Content[i+1] = &resolved
+		}
+	}
+	s.root = merged
+	return problems
+}
+
+// stepIndex returns the index of the step named as the step node, or as the scalar node,
+// in the steps sequence, -1 if there is none.
+func stepIndex(steps *yaml.Node, node *yaml.Node) int {
+	name := node.Value
+	if node.Kind == yaml.MappingNode {
+		_, nameNode := mappingValue(node, "name")
+		if nameNode == nil {
+			return -1
+		}
+		name = nameNode.Value
+	}
+	for i, step := range steps.Content {
+		if _, stepName := mappingValue(step, "name"); stepName != nil && stepName.Value == name {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,204 @@
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"gopkg.in/yaml.v3"
+)
+
+// writeFiles writes the files, by name, in a directory and returns it.
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+const terraformTemplates = `templates:
+  terraform:
+    project-id: infra
+    manual: true
+    tags: terraform
+    substitutions:
+      _WORKSPACE: default
+      _VERSION: "1.2"
+  plan:
+    extends: terraform
+    manual: false
+    trigger: plan
+`
+
+func TestUnmarshalIncludesAndTemplates(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"templates.yaml": terraformTemplates,
+		"common.yaml": `include:
+  - templates.yaml
+substitutions:
+  _ENV: dev
+  _OWNER: platform
+steps:
+  - name: lint
+    trigger: lint
+    project-id: infra
+`,
+		"cork.yaml": `name: network
+include:
+  - common.yaml
+substitutions:
+  _ENV: prod
+steps:
+  - name: plan
+    extends: plan
+    substitutions:
+      _WORKSPACE: network
+  - name: apply
+    extends: terraform
+    trigger: apply
+    depends-on:
+      - plan
+`,
+	})
+
+	config, err := Unmarshal(filepath.Join(dir, "cork.yaml"), Overrides{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Config{
+		ConfigFile:    filepath.Join(dir, "cork.yaml"),
+		Name:          "network",
+		Substitutions: map[string]string{"_ENV": "prod", "_OWNER": "platform"},
+		Steps: []Step{
+			{Name: "lint", Trigger: "lint", ProjectId: "infra"},
+			{
+				Name:          "plan",
+				Trigger:       "plan",
+				ProjectId:     "infra",
+				Tags:          Tags{"terraform"},
+				Substitutions: map[string]string{"_WORKSPACE": "network", "_VERSION": "1.2"},
+			},
+			{
+				Name:          "apply",
+				Trigger:       "apply",
+				ProjectId:     "infra",
+				Manual:        true,
+				Tags:          Tags{"terraform"},
+				DependsOn:     []string{"plan"},
+				Substitutions: map[string]string{"_WORKSPACE": "default", "_VERSION": "1.2"},
+			},
+		},
+	}
+	if d := cmp.Diff(expected, config); d != "" {
+		t.Errorf("unexpected config (-want, +got): %s", d)
+	}
+
+	// The rendered config reads the same without its includes and templates.
+	rendered, err := yaml.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	renderedPath := filepath.Join(t.TempDir(), "cork.yaml")
+	if err := ioutil.WriteFile(renderedPath, rendered, 0644); err != nil {
+		t.Fatal(err)
+	}
+	reread, err := Unmarshal(renderedPath, Overrides{})
+	if err != nil {
+		t.Fatalf("unexpected error reading the rendered config: %s", err)
+	}
+	expected.ConfigFile = renderedPath
+	if d := cmp.Diff(expected, reread); d != "" {
+		t.Errorf("unexpected rendered config (-want, +got): %s", d)
+	}
+
+	files := []string{filepath.Join(dir, "cork.yaml"), filepath.Join(dir, "common.yaml"), filepath.Join(dir, "templates.yaml")}
+	if d := cmp.Diff(files, SourceFiles(filepath.Join(dir, "cork.yaml"))); d != "" {
+		t.Errorf("unexpected source files (-want, +got): %s", d)
+	}
+}
+
+func TestUnmarshalIncludeProblems(t *testing.T) {
+	tcs := []struct {
+		name     string
+		files    map[string]string
+		expected []string
+	}{
+		{
+			name: "undefined template",
+			files: map[string]string{
+				"steps.yaml": "steps:\n  - name: a\n    extends: missing\n",
+				"cork.yaml":  "name: demo\ninclude:\n  - steps.yaml\n",
+			},
+			expected: []string{"steps.yaml:3: undefined template missing"},
+		},
+		{
+			name: "template cycle",
+			files: map[string]string{
+				"cork.yaml": "name: demo\ntemplates:\n  a:\n    extends: b\n  b:\n    extends: a\nsteps:\n  - name: s\n    extends: a\n",
+			},
+			expected: []string{"cork.yaml:6: template cycle: a -> b -> a"},
+		},
+		{
+			name: "include cycle",
+			files: map[string]string{
+				"other.yaml": "include:\n  - cork.yaml\n",
+				"cork.yaml":  "name: demo\ninclude:\n  - other.yaml\n",
+			},
+			expected: []string{"other.yaml:2: include cycle: cork.yaml -> other.yaml -> cork.yaml"},
+		},
+		{
+			name: "missing include",
+			files: map[string]string{
+				"cork.yaml": "name: demo\ninclude:\n  - missing.yaml\n",
+			},
+			expected: []string{"cork.yaml:3: can't include missing.yaml: open missing.yaml: no such file or directory"},
+		},
+		{
+			name: "unknown key in an included file",
+			files: map[string]string{
+				"steps.yaml": "steps:\n  - name: a\n    trigers: a\n",
+				"cork.yaml":  "name: demo\ninclude:\n  - steps.yaml\n",
+			},
+			expected: []string{"steps.yaml:3: unknown key trigers in step"},
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := writeFiles(t, tc.files)
+			_, err := Unmarshal(filepath.Join(dir, "cork.yaml"), Overrides{})
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			problems := strings.Split(strings.ReplaceAll(err.Error(), dir+"/", ""), "\n")
+			if d := cmp.Diff(tc.expected, problems); d != "" {
+				t.Errorf("unexpected problems (-want, +got): %s", d)
+			}
+		})
+	}
+}
+
+func TestLeaveOutFragments(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"templates.yaml": terraformTemplates,
+		"common.yaml":    "include:\n  - templates.yaml\nsubstitutions:\n  _ENV: dev\n",
+		"network.yaml":   "name: network\ninclude:\n  - common.yaml\n",
+		"app.yaml":       "name: app\nsteps: []\n",
+		"shared.yaml":    "steps:\n  - name: lint\n",
+	})
+	paths := []string{}
+	for _, name := range []string{"app.yaml", "common.yaml", "network.yaml", "shared.yaml", "templates.yaml"} {
+		paths = append(paths, filepath.Join(dir, name))
+	}
+
+	expected := []string{filepath.Join(dir, "app.yaml"), filepath.Join(dir, "network.yaml"), filepath.Join(dir, "shared.yaml")}
+	if d := cmp.Diff(expected, LeaveOutFragments(paths)); d != "" {
+		t.Errorf("unexpected configs (-want, +got): %s", d)
+	}
+}
@@ -0,0 +1,124 @@
+package config
+
+import (
+	"cork/utils"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Label selector operators.
+const (
+	LabelEquals    = "="
+	LabelNotEquals = "!="
+	LabelIn        = "in"
+	LabelNotIn     = "notin"
+	LabelExists    = "exists"
+	LabelNotExists = "!"
+)
+
+var (
+	labelKeyPattern     = `[A-Za-z0-9][A-Za-z0-9_.\-/]*`
+	labelSetRegex       = regexp.MustCompile(`^(` + labelKeyPattern + `)\s+(in|notin)\s*\(([^()]*)\)$`)
+	labelEqualityRegex  = regexp.MustCompile(`^(` + labelKeyPattern + `)\s*(!=|==|=)\s*([^\s,()=!]*)$`)
+	labelExistenceRegex = regexp.MustCompile(`^(!?)\s*(` + labelKeyPattern + `)$`)
+)
+
+// labelRequirement matches the steps whose label has one of the values, possibly with
+// wildcards, or, with LabelExists and LabelNotExists, the steps having the label or not.
+type labelRequirement struct {
+	key      string
+	operator string
+	values   []string
+}
+
+func (requirement labelRequirement) Match(step Step) (bool, []string) {
+	value, ok := step.Labels[requirement.key]
+	matched := false
+	switch requirement.operator {
+	case LabelEquals, LabelIn:
+		matched = ok && utils.MatchAtLeastOne(requirement.values, value)
+	case LabelNotEquals, LabelNotIn:
+		matched = !ok || !utils.MatchAtLeastOne(requirement.values, value)
+	case LabelExists:
+		matched = ok
+	case LabelNotExists:
+		matched = !ok
+	}
+	fact := "no label " + requirement.key
+	if ok {
+		fact = "label " + requirement.key + "=" + value
+	}
+	if matched {
+		return true, []string{fact + " matches " + requirement.String()}
+	}
+	return false, []string{fact + " doesn't match " + requirement.String()}
+}
+
+func (requirement labelRequirement) String() string {
+	switch requirement.operator {
+	case LabelIn, LabelNotIn:
+		return requirement.key + " " + requirement.operator + " (" + strings.Join(requirement.values, ",") + ")"
+	case LabelExists:
+		return requirement.key
+	case LabelNotExists:
+		return "!" + requirement.key
+	}
+	return requirement.key + requirement.operator + requirement.values[0]
+}
+
+// splitLabelSelector splits a label selector at the commas outside of parentheses.
+func splitLabelSelector(selector string) []string {
+	parts := []string{}
+	depth, start := 0, 0
+	for i, c := range selector {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, selector[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, selector[start:])
+}
+
+// ParseLabelSelector parses a label selector, requirements separated by commas that the
+// labels of the steps must all meet, such as env=prod,team in (payments,ledger):
+//   - key=value, or key==value, and key!=value, the latter matching the steps without the label too;
+//   - key in (value1,value2) and key notin (value1,value2), the latter matching the steps without the label too;
+//   - key and !key, matching the steps having the label or not.
+//
+// The values may have wildcards.
+func ParseLabelSelector(selector string) (Selector, error) {
+	and := selectorAnd{}
+	for _, part := range splitLabelSelector(selector) {
+		part = strings.TrimSpace(part)
+		if match := labelSetRegex.FindStringSubmatch(part); match != nil {
+			values := utils.RemoveEmptyStrings(strings.Split(match[3], ","))
+			if len(values) == 0 {
+				return nil, fmt.Errorf("invalid label selector %q: no values in %s", selector, part)
+			}
+			and.operands = append(and.operands, labelRequirement{key: match[1], operator: match[2], values: values})
+		} else if match := labelEqualityRegex.FindStringSubmatch(part); match != nil {
+			operator := match[2]
+			if operator == "==" {
+				operator = LabelEquals
+			}
+			and.operands = append(and.operands, labelRequirement{key: match[1], operator: operator, values: []string{match[3]}})
+		} else if match := labelExistenceRegex.FindStringSubmatch(part); match != nil {
+			operator := LabelExists
+			if match[1] != "" {
+				operator = LabelNotExists
+			}
+			and.operands = append(and.operands, labelRequirement{key: match[2], operator: operator})
+		} else {
+			return nil, fmt.Errorf("invalid label selector %q: can't parse %q, expected key=value, key!=value, key in (values), key notin (values), key or !key", selector, part)
+		}
+	}
+	return and, nil
+}
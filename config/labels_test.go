@@ -0,0 +1,92 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseLabelSelector(t *testing.T) {
+	tcs := []struct {
+		selector    string
+		expected    string
+		expectedErr string
+	}{
+		{selector: "env=prod", expected: "env=prod"},
+		{selector: "env == prod, team in (payments, ledger)", expected: "env=prod && team in (payments,ledger)"},
+		{selector: "env!=dev,tier notin (web),canary,!legacy", expected: "env!=dev && tier notin (web) && canary && !legacy"},
+		{selector: "region=europe-*", expected: "region=europe-*"},
+		{selector: "", expectedErr: `invalid label selector "": can't parse "", expected key=value, key!=value, key in (values), key notin (values), key or !key`},
+		{selector: "team in ()", expectedErr: `invalid label selector "team in ()": no values in team in ()`},
+		{selector: "env=prod,team in payments", expectedErr: `invalid label selector "env=prod,team in payments": can't parse "team in payments", expected key=value, key!=value, key in (values), key notin (values), key or !key`},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.selector, func(t *testing.T) {
+			selector, err := ParseLabelSelector(tc.selector)
+			if tc.expectedErr != "" {
+				if err == nil || err.Error() != tc.expectedErr {
+					t.Fatalf("got error %v, want %s", err, tc.expectedErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := selector.String(); got != tc.expected {
+				t.Errorf("got %s, want %s", got, tc.expected)
+			}
+		})
+	}
+}
+
+func TestLabelSelectorMatch(t *testing.T) {
+	step := Step{Name: "deploy", Labels: map[string]string{"env": "prod", "team": "ledger"}}
+	tcs := []struct {
+		selector        string
+		expected        bool
+		expectedReasons []string
+	}{
+		{
+			selector:        "env=prod,team in (payments,ledger)",
+			expected:        true,
+			expectedReasons: []string{"label env=prod matches env=prod", "label team=ledger matches team in (payments,ledger)"},
+		},
+		{
+			selector:        "env=prod,team notin (ledger)",
+			expected:        false,
+			expectedReasons: []string{"label team=ledger doesn't match team notin (ledger)"},
+		},
+		{
+			selector:        "tier!=web,!canary",
+			expected:        true,
+			expectedReasons: []string{"no label tier matches tier!=web", "no label canary matches !canary"},
+		},
+		{
+			selector:        "tier",
+			expected:        false,
+			expectedReasons: []string{"no label tier doesn't match tier"},
+		},
+		{
+			selector:        "env=p*",
+			expected:        true,
+			expectedReasons: []string{"label env=prod matches env=p*"},
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.selector, func(t *testing.T) {
+			selector, err := ParseLabelSelector(tc.selector)
+			if err != nil {
+				t.Fatal(err)
+			}
+			matched, reasons := selector.Match(step)
+			if matched != tc.expected {
+				t.Errorf("got %v, want %v", matched, tc.expected)
+			}
+			if d := cmp.Diff(tc.expectedReasons, reasons); d != "" {
+				t.Errorf("unexpected reasons (-want, +got): %s", d)
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package config
+
+import (
+	"cork/utils"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// matrixVariableRegex matches the values of the matrix of a step, ${matrix.NAME}, and
+// their escaped form $${matrix.NAME} kept as ${matrix.NAME}.
+var matrixVariableRegex = regexp.MustCompile(`\$?\$\{matrix\.([^}]+)\}`)
+
+// matrixKeys are the keys of a step whose values are interpolated with its matrix values.
+var matrixKeys = []string{"trigger", "project-id", "region", "description", "substitutions", "labels", "depends-on"}
+
+// MatrixName returns the name of the expansion of a step for the values of its matrix.
+func MatrixName(name string, values []string) string {
+	return name + " (" + strings.Join(values, ", ") + ")"
+}
+
+// matrixEntry is a variable of a matrix with its values.
+type matrixEntry struct {
+	name   string
+	values []string
+}
+
+// combinations returns every combination of the values of the entries, the values of
+// the first entry varying last.
+func combinations(entries []matrixEntry) []map[string]string {
+	combinations := []map[string]string{{}}
+	for _, entry := range entries {
+		expanded := []map[string]string{}
+		for _, combination := range combinations {
+			for _, value := range entry.values {
+				next := map[string]string{entry.name: value}
+				for k, v := range combination {
+					next[k] = v
+				}
+				expanded = append(expanded, next)
+			}
+		}
+		combinations = expanded
+	}
+	return combinations
+}
+
+// uninterpolatedMatrixProblems returns a problem for every reference to a matrix value
+// left in the step once expanded: in the keys whose values aren't interpolated or, for a
+// step without a matrix, in any key.
+func (s *source) uninterpolatedMatrixProblems(step *yaml.Node, name *yaml.Node, hasMatrix bool) []Problem {
+	if step.Kind != yaml.MappingNode {
+		return nil
+	}
+	stepName := ""
+	if name != nil {
+		stepName = name.Value
+	}
+	problems := []Problem{}
+	for i := 0; i+1 < len(step.Content); i += 2 {
+		key := step.Content[i].Value
+		if hasMatrix && utils.Contains(matrixKeys, key) {
+			continue
+		}
+		for _, node := range scalarNodes(step.Content[i+1]) {
+			for _, match := range matrixVariableRegex.FindAllString(node.Value, -1) {
+				if match[1] == '$' {
+					continue
+				}
+				message := "step " + stepName + " has no matrix for " + match
+				if hasMatrix {
+					message = "matrix values aren't interpolated in the " + key + " of step " + stepName + ", as " + match
+				}
+				problems = append(problems, s.problem(node, message))
+			}
+		}
+	}
+	return problems
+}
+
+// expandMatrices replaces every step with a matrix by one step for each combination of
+// the values of its matrix, named by MatrixName, whose matrix values are interpolated.
+// The dependencies on a step with a matrix are replaced by dependencies on all of its
+// expansions.
+func (s *source) expandMatrices() []Problem {
+	_, steps := mappingValue(s.root, "steps")
+	if steps == nil || steps.Kind != yaml.SequenceNode {
+		return nil
+	}
+	problems := []Problem{}
+	// The values shared by the expansions of a step are reported once.
+	seen := map[Problem]bool{}
+	groups := map[string][]string{}
+	expanded := []*yaml.Node{}
+	for _, step := range steps.Content {
+		matrixKey, matrix := mappingValue(step, "matrix")
+		_, name := mappingValue(step, "name")
+		problems = append(problems, s.uninterpolatedMatrixProblems(step, name, matrix != nil)...)
+		if matrix == nil || name == nil {
+			expanded = append(expanded, step)
+			continue
+		}
+		entries := []matrixEntry{}
+		if matrix.Kind == yaml.MappingNode {
+			for i := 0; i+1 < len(matrix.Content); i += 2 {
+				entry := matrixEntry{name: matrix.Content[i].Value}
+				for _, value := range matrix.Content[i+1].Content {
+					entry.values = append(entry.values, value.Value)
+				}
+				entries = append(entries, entry)
+			}
+		}
+		valid := len(entries) > 0
+		for _, entry := range entries {
+			valid = valid && len(entry.values) > 0
+		}
+		if !valid {
+			problems = append(problems, s.problem(matrixKey, "the matrix of step "+name.Value+" must list values for each of its variables"))
+			expanded = append(expanded, step)
+			continue
+		}
+
+		for _, combination := range combinations(entries) {
+			values := []string{}
+			for _, entry := range entries {
+				values = append(values, combination[entry.name])
+			}
+			expansion := *step
+			s.origins[&expansion] = s.origins[step]
+			expansion.Content = []*yaml.Node{}
+			for i := 0; i+1 < len(step.Content); i += 2 {
+				key, value := step.Content[i], step.Content[i+1]
+				switch key.Value {
+				case "matrix":
+					continue
+				case "name":
+					renamed := *value
+					renamed.Value = MatrixName(value.Value, values)
+					s.origins[&renamed] = s.origins[value]
+					value = &renamed
+				}
+				expansion.Content = append(expansion.Content, key, value)
+			}
+			s.interpolateKeys(&expansion, matrixKeys, func(node *yaml.Node, value string) string {
+				return matrixVariableRegex.ReplaceAllStringFunc(value, func(match string) string {
+					if match[1] == '$' {
+						return match[1:]
+					}
+					variable := matrixVariableRegex.FindStringSubmatch(match)[1]
+					resolved, ok := combination[variable]
+					if !ok {
+						if problem := s.problem(node, "undefined matrix variable "+variable+" in step "+name.Value); !seen[problem] {
+							seen[problem] = true
+							problems = append(problems, problem)
+						}
+						return match
+					}
+					return resolved
+				})
+			})
+			groups[name.Value] = append(groups[name.Value], MatrixName(name.Value, values))
+			expanded = append(expanded, &expansion)
+		}
+	}
+
+	for _, step := range expanded {
+		keyNode, dependsOn := mappingValue(step, "depends-on")
+		if dependsOn == nil || dependsOn.Kind != yaml.SequenceNode {
+			continue
+		}
+		rewired := *dependsOn
+		s.origins[&rewired] = s.origins[dependsOn]
+		rewired.Content = []*yaml.Node{}
+		for _, dependency := range dependsOn.Content {
+			names, ok := groups[dependency.Value]
+			if !ok {
+				rewired.Content = append(rewired.Content, dependency)
+				continue
+			}
+			for _, name := range names {
+				item := *dependency
+				item.Value = name
+				s.origins[&item] = s.origins[dependency]
+				rewired.Content = append(rewired.Content, &item)
+			}
+		}
+		for i := 0; i+1 < len(step.Content); i += 2 {
+			if step.Content[i] == keyNode {
+				step.Content[i+1] = &rewired
+			}
+		}
+	}
+	expandedSteps := *steps
+	expandedSteps.Content = expanded
+	s.origins[&expandedSteps] = s.origins[steps]
+	for i := 0; i+1 < len(s.root.Content); i += 2 {
+		if s.root.Content[i].Value == "steps" {
+			s.root.Content[i+1] = &expandedSteps
+		}
+	}
+	return problems
+}
@@ -0,0 +1,114 @@
+package config
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestUnmarshalMatrix(t *testing.T) {
+	dir := writeFiles(t, map[string]string{"cork.yaml": `name: app
+steps:
+  - name: build
+    trigger: build
+    project-id: app
+  - name: deploy
+    trigger: deploy-${matrix.tier}
+    project-id: app-${matrix.region}
+    region: ${matrix.region}-west1
+    description: Deploys the ${matrix.tier} tier, not $${matrix.tier}
+    depends-on:
+      - build
+    matrix:
+      region: [eu, us]
+      tier: [web, api]
+    substitutions:
+      _REGION: ${matrix.region}
+  - name: smoke
+    trigger: smoke
+    project-id: app-${matrix.region}
+    depends-on:
+      - deploy (${matrix.region}, web)
+    matrix:
+      region: [eu, us]
+  - name: notify
+    trigger: notify
+    project-id: app
+    depends-on:
+      - smoke
+`})
+
+	config, err := Unmarshal(filepath.Join(dir, "cork.yaml"), Overrides{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deploy := func(region string, tier string) Step {
+		return Step{
+			Name:          "deploy (" + region + ", " + tier + ")",
+			Trigger:       "deploy-" + tier,
+			ProjectId:     "app-" + region,
+			Region:        region + "-west1",
+			Description:   "Deploys the " + tier + " tier, not ${matrix.tier}",
+			DependsOn:     []string{"build"},
+			Substitutions: map[string]string{"_REGION": region},
+		}
+	}
+	expected := []Step{
+		{Name: "build", Trigger: "build", ProjectId: "app"},
+		deploy("eu", "web"),
+		deploy("eu", "api"),
+		deploy("us", "web"),
+		deploy("us", "api"),
+		{Name: "smoke (eu)", Trigger: "smoke", ProjectId: "app-eu", DependsOn: []string{"deploy (eu, web)"}},
+		{Name: "smoke (us)", Trigger: "smoke", ProjectId: "app-us", DependsOn: []string{"deploy (us, web)"}},
+		{Name: "notify", Trigger: "notify", ProjectId: "app", DependsOn: []string{"smoke (eu)", "smoke (us)"}},
+	}
+	if d := cmp.Diff(expected, config.Steps); d != "" {
+		t.Errorf("unexpected steps (-want, +got): %s", d)
+	}
+}
+
+func TestUnmarshalMatrixProblems(t *testing.T) {
+	tcs := []struct {
+		name     string
+		content  string
+		expected []string
+	}{
+		{
+			name:     "undefined matrix variable",
+			content:  "name: app\nsteps:\n  - name: a\n    trigger: ${matrix.zone}\n    project-id: p\n    matrix:\n      region: [eu, us]\n",
+			expected: []string{"cork.yaml:4: undefined matrix variable zone in step a"},
+		},
+		{
+			name:     "matrix without values",
+			content:  "name: app\nsteps:\n  - name: a\n    trigger: a\n    project-id: p\n    matrix:\n      region: []\n",
+			expected: []string{"cork.yaml:6: the matrix of step a must list values for each of its variables"},
+		},
+		{
+			name:     "matrix variable in a key that isn't interpolated",
+			content:  "name: app\nsteps:\n  - name: a\n    trigger: a\n    project-id: p\n    tags:\n      - ${matrix.region}\n    matrix:\n      region: [eu, us]\n",
+			expected: []string{"cork.yaml:7: matrix values aren't interpolated in the tags of step a, as ${matrix.region}"},
+		},
+		{
+			name:     "matrix variable in a step without matrix",
+			content:  "name: app\nsteps:\n  - name: a\n    trigger: a-${matrix.region}\n    project-id: p\n    description: $${matrix.region} is literal\n",
+			expected: []string{"cork.yaml:4: step a has no matrix for ${matrix.region}"},
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := writeFiles(t, map[string]string{"cork.yaml": tc.content})
+			_, err := Unmarshal(filepath.Join(dir, "cork.yaml"), Overrides{})
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			problems := strings.Split(strings.ReplaceAll(err.Error(), dir+"/", ""), "\n")
+			if d := cmp.Diff(tc.expected, problems); d != "" {
+				t.Errorf("unexpected problems (-want, +got): %s", d)
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package config
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+const profilesConfig = `name: app
+vars:
+  ENV: dev
+substitutions:
+  _REGION: europe-west1
+  _TIER: small
+steps:
+  - name: build
+    trigger: build
+    project-id: app-${ENV}
+  - name: seed
+    trigger: seed
+    project-id: app-${ENV}
+    depends-on:
+      - build
+  - name: deploy
+    trigger: deploy
+    project-id: app-${ENV}
+    depends-on:
+      - build
+profiles:
+  prod:
+    vars:
+      ENV: prod
+    substitutions:
+      _TIER: large
+    remove:
+      - seed
+    steps:
+      - name: deploy
+        manual: true
+        project-id: app-prod-eu
+      - name: smoke
+        trigger: smoke
+        project-id: app-prod
+        depends-on:
+          - deploy
+`
+
+func TestUnmarshalProfile(t *testing.T) {
+	tcs := []struct {
+		name     string
+		profile  string
+		expected Config
+	}{
+		{
+			name:    "base",
+			profile: "",
+			expected: Config{
+				Name:          "app",
+				Substitutions: map[string]string{"_REGION": "europe-west1", "_TIER": "small"},
+				Steps: []Step{
+					{Name: "build", Trigger: "build", ProjectId: "app-dev"},
+					{Name: "seed", Trigger: "seed", ProjectId: "app-dev", DependsOn: []string{"build"}},
+					{Name: "deploy", Trigger: "deploy", ProjectId: "app-dev", DependsOn: []string{"build"}},
+				},
+			},
+		},
+		{
+			name:    "prod",
+			profile: "prod",
+			expected: Config{
+				Name:          "app",
+				Substitutions: map[string]string{"_REGION": "europe-west1", "_TIER": "large"},
+				Steps: []Step{
+					{Name: "build", Trigger: "build", ProjectId: "app-prod"},
+					{Name: "deploy", Trigger: "deploy", ProjectId: "app-prod-eu", DependsOn: []string{"build"}, Manual: true},
+					{Name: "smoke", Trigger: "smoke", ProjectId: "app-prod", DependsOn: []string{"deploy"}},
+				},
+			},
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := writeFiles(t, map[string]string{"cork.yaml": profilesConfig})
+			config, err := Unmarshal(filepath.Join(dir, "cork.yaml"), Overrides{Profile: tc.profile})
+			if err != nil {
+				t.Fatal(err)
+			}
+			tc.expected.ConfigFile = filepath.Join(dir, "cork.yaml")
+			if d := cmp.Diff(tc.expected, config); d != "" {
+				t.Errorf("unexpected config (-want, +got): %s", d)
+			}
+		})
+	}
+}
+
+func TestUnmarshalProfileProblems(t *testing.T) {
+	tcs := []struct {
+		name     string
+		content  string
+		expected []string
+	}{
+		{
+			name:     "undefined profile",
+			content:  "name: app\nsteps: []\nprofiles:\n  staging: {}\n",
+			expected: []string{"cork.yaml:3: undefined profile prod"},
+		},
+		{
+			name:     "removing an undefined step",
+			content:  "name: app\nsteps: []\nprofiles:\n  prod:\n    remove:\n      - seed\n",
+			expected: []string{"cork.yaml:6: profile prod removes undefined step seed"},
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := writeFiles(t, map[string]string{"cork.yaml": tc.content})
+			_, err := Unmarshal(filepath.Join(dir, "cork.yaml"), Overrides{Profile: "prod"})
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			problems := strings.Split(strings.ReplaceAll(err.Error(), dir+"/", ""), "\n")
+			if d := cmp.Diff(tc.expected, problems); d != "" {
+				t.Errorf("unexpected problems (-want, +got): %s", d)
+			}
+		})
+	}
+}
+
+func TestUnmarshalWithoutProfiles(t *testing.T) {
+	dir := writeFiles(t, map[string]string{"cork.yaml": "name: app\nsteps:\n  - name: a\n    trigger: a\n    project-id: p\n"})
+	config, err := Unmarshal(filepath.Join(dir, "cork.yaml"), Overrides{Profile: "prod"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Steps) != 1 {
+		t.Errorf("expected the config without profiles to be left as it is, got %v", config.Steps)
+	}
+}
@@ -0,0 +1,181 @@
+package config
+
+import (
+	"bytes"
+	"cork/gcp"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// SchemaId is the identifier of the JSON Schema of the config files.
+const SchemaId = "https://github.com/echaouchna/cloudbuild-orchestrator/cork.schema.json"
+
+// durationPattern matches the durations accepted by time.ParseDuration, e.g. 1m30s.
+const durationPattern = `^([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+$`
+
+// schemaDescriptions documents the fields of the config, by type and field name.
+// Every field written in a config file must have one.
+var schemaDescriptions = map[string]string{
+	"Config.Author":        "Author of the pipeline.",
+	"Config.Description":   "Description of the pipeline.",
+	"Config.Name":          "Name of the pipeline, prefixing its output.",
+	"Config.Steps":         "Steps of the pipeline, each running a Cloud Build trigger.",
+	"Config.Substitutions": "Default substitutions passed to the trigger of every step.",
+	"Config.Region":        "Default region of the triggers of the steps, global when empty.",
+	"Config.Include":       "Config files merged under this one, relative to it: their steps come first and their other keys are overridden.",
+	"Config.Templates":     "Step templates by name, whose fields are overridden by the steps extending them.",
+	"Config.Vars":          "Default values of the variables interpolated as ${NAME} in the descriptions, regions, triggers, project IDs, substitutions, labels and dependencies, overridden by the environment and -var.",
+	"Config.Profiles":      "Overlays of the pipeline by name, the one selected with -profile being merged onto it.",
+
+	"Profile.Description":   "Description replacing the one of the pipeline.",
+	"Profile.Region":        "Default region of the triggers replacing the one of the pipeline.",
+	"Profile.Substitutions": "Default substitutions merged onto those of the pipeline.",
+	"Profile.Vars":          "Default values of the variables merged onto those of the pipeline.",
+	"Profile.Templates":     "Step templates merged by name onto those of the pipeline.",
+	"Profile.Steps":         "Steps merged field by field onto the steps of the pipeline with the same name, the others being added.",
+	"Profile.Remove":        "Names of the steps of the pipeline removed by the profile.",
+
+	"Step.DependsOn":     "Names of the steps that must succeed before this one starts, as config:step for a step of another config run along.",
+	"Step.Description":   "Description of the step.",
+	"Step.Manual":        "Whether the step waits for a manual validation before starting.",
+	"Step.Name":          "Name of the step, unique in the pipeline.",
+	"Step.ProjectId":     "Google Cloud project of the trigger.",
+	"Step.Status":        "Status of the step, set by cork in run states.",
+	"Step.Tags":          "Tags matched by -include, -exclude and -select, as a list or separated by commas.",
+	"Step.Trigger":       "Name of the Cloud Build trigger run by the step.",
+	"Step.Region":        "Region of the trigger, overriding the default region of the pipeline.",
+	"Step.LogUrl":        "Log URL of the build of the step, set by cork in run states.",
+	"Step.BuildId":       "ID of the build of the step, set by cork in run states.",
+	"Step.CommitSha":     "Commit the build of the step ran on, set by cork in run states.",
+	"Step.Duration":      "Duration of the step, set by cork in run states.",
+	"Step.Retry":         "Retry policy of the step when its build doesn't succeed.",
+	"Step.Attempts":      "Number of builds of the step started, set by cork in run states.",
+	"Step.Substitutions": "Substitutions passed to the trigger, overriding the defaults of the pipeline. Values can reference the outputs of upstream steps with ${steps.<name>.outputs.<output>}.",
+	"Step.Outputs":       "Outputs of the build of the step, set by cork in run states.",
+	"Step.Labels":        "Labels by key, matched by -labels selectors such as env=prod,team in (payments,ledger).",
+	"Step.Extends":       "Name of the template the fields of the step override.",
+	"Step.Matrix":        "Values by variable, the step being expanded into a step named \"name (value, ...)\" for each combination of them, with ${matrix.<variable>} replaced in its trigger, project-id, region, description, substitutions, labels and dependencies. Depending on the step depends on all of its expansions.",
+
+	"RetryPolicy.MaxAttempts": "Maximum number of builds of the step, counting the first one.",
+	"RetryPolicy.Backoff":     "Delay before the first retry, doubled for each following retry.",
+	"RetryPolicy.On":          "Statuses to retry, FAILURE, TIMEOUT and INTERNAL_ERROR when empty.",
+}
+
+// schemaEnums lists the values allowed for a field, or for the items of a list field.
+var schemaEnums = map[string][]string{
+	"Step.Status": append(
+		append([]string{gcp.RUNNING, gcp.STATUS_UNKNOWN, gcp.PENDING, gcp.QUEUED, gcp.WORKING}, gcp.FinalStatuses...),
+		SKIPPED, REJECTED, ERROR, ABORTED,
+	),
+	"RetryPolicy.On": gcp.FailureStatuses,
+}
+
+// schemaRequired lists the fields a config file must set, by type. The trigger and project-id
+// of a step aren't required as they may come from a template, see Validate.
+var schemaRequired = map[string][]string{
+	"Config": {"name", "steps"},
+}
+
+// yamlKey returns the key of a field in a config file, empty if it isn't written.
+func yamlKey(field reflect.StructField) string {
+	key := strings.Split(field.Tag.Get("yaml"), ",")[0]
+	if key == "-" {
+		return ""
+	}
+	if key == "" {
+		return strings.ToLower(field.Name)
+	}
+	return key
+}
+
+func typeSchema(t reflect.Type, definitions map[string]interface{}) map[string]interface{} {
+	if t == reflect.TypeOf(time.Duration(0)) {
+		return map[string]interface{}{"type": "string", "pattern": durationPattern}
+	}
+	if t == reflect.TypeOf(Tags{}) {
+		return map[string]interface{}{"oneOf": []interface{}{
+			map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+			map[string]interface{}{"type": "string"},
+		}}
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem(), definitions)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": typeSchema(t.Elem(), definitions)}
+	case reflect.Ptr:
+		return typeSchema(t.Elem(), definitions)
+	case reflect.Struct:
+		if _, ok := definitions[t.Name()]; !ok {
+			// Reserved before recursing, for the types referencing themselves.
+			definitions[t.Name()] = nil
+			definitions[t.Name()] = structSchema(t, definitions)
+		}
+		return map[string]interface{}{"$ref": "#/definitions/" + t.Name()}
+	}
+	panic("no JSON Schema for the type " + t.String())
+}
+
+func structSchema(t reflect.Type, definitions map[string]interface{}) map[string]interface{} {
+	properties := map[string]interface{}{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		key := yamlKey(field)
+		if key == "" {
+			continue
+		}
+		property := typeSchema(field.Type, definitions)
+		name := t.Name() + "." + field.Name
+		if description, ok := schemaDescriptions[name]; ok {
+			property["description"] = description
+		}
+		if enum, ok := schemaEnums[name]; ok {
+			if items, ok := property["items"].(map[string]interface{}); ok {
+				items["enum"] = enum
+			} else {
+				property["enum"] = enum
+			}
+		}
+		properties[key] = property
+	}
+	schema := map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+	if required, ok := schemaRequired[t.Name()]; ok {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// Schema returns the JSON Schema of the config files, generated from Config.
+func Schema() map[string]interface{} {
+	definitions := map[string]interface{}{}
+	schema := structSchema(reflect.TypeOf(Config{}), definitions)
+	schema["$schema"] = "http://json-schema.org/draft-07/schema#"
+	schema["$id"] = SchemaId
+	schema["title"] = "cork pipeline config"
+	schema["definitions"] = definitions
+	return schema
+}
+
+// SchemaJSON returns the indented JSON of Schema.
+func SchemaJSON() ([]byte, error) {
+	out := bytes.Buffer{}
+	encoder := json.NewEncoder(&out)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(Schema()); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
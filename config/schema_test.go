@@ -0,0 +1,36 @@
+package config
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSchemaDescribesEveryField(t *testing.T) {
+	for _, value := range []interface{}{Config{}, Step{}, RetryPolicy{}} {
+		structType := reflect.TypeOf(value)
+		for i := 0; i < structType.NumField(); i++ {
+			field := structType.Field(i)
+			name := structType.Name() + "." + field.Name
+			if _, ok := schemaDescriptions[name]; yamlKey(field) != "" && !ok {
+				t.Errorf("%s has no description in schemaDescriptions", name)
+			}
+		}
+	}
+}
+
+func TestSchemaFileUpToDate(t *testing.T) {
+	published, err := ioutil.ReadFile("../cork.schema.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	generated, err := SchemaJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := cmp.Diff(string(published), string(generated)); d != "" {
+		t.Errorf("cork.schema.json is out of date, run make schema (-published, +generated): %s", d)
+	}
+}
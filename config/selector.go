@@ -0,0 +1,392 @@
+package config
+
+import (
+	"cork/utils"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Selector qualifiers, a term without qualifier matching the tags of the steps.
+const (
+	TagQualifier     = "tag"
+	NameQualifier    = "name"
+	ProjectQualifier = "project"
+	TriggerQualifier = "trigger"
+)
+
+var selectorQualifiers = []string{NameQualifier, ProjectQualifier, TagQualifier, TriggerQualifier}
+
+// Selector is a boolean expression selecting steps, see ParseSelector.
+type Selector interface {
+	// Match tells whether the step is selected, along with the facts it depends on.
+	Match(step Step) (bool, []string)
+	String() string
+}
+
+// selectorTerm matches the steps having a tag, or the qualified field, matching a pattern
+// possibly with wildcards.
+type selectorTerm struct {
+	qualifier string
+	pattern   string
+}
+
+func (term selectorTerm) Match(step Step) (bool, []string) {
+	if term.qualifier == TagQualifier {
+		for _, tag := range step.Tags {
+			if utils.MatchAtLeastOne([]string{term.pattern}, tag) {
+				return true, []string{"tag " + tag + " matches " + term.String()}
+			}
+		}
+		return false, []string{"no tag matches " + term.String()}
+	}
+	value := step.Name
+	switch term.qualifier {
+	case ProjectQualifier:
+		value = step.ProjectId
+	case TriggerQualifier:
+		value = step.Trigger
+	}
+	if utils.MatchAtLeastOne([]string{term.pattern}, value) {
+		return true, []string{term.qualifier + " " + strconv.Quote(value) + " matches " + term.String()}
+	}
+	return false, []string{term.qualifier + " " + strconv.Quote(value) + " doesn't match " + term.String()}
+}
+
+func (term selectorTerm) String() string {
+	pattern := term.pattern
+	if pattern == "" || strings.ContainsAny(pattern, " \t()!&|\"") {
+		pattern = strconv.Quote(pattern)
+	}
+	if term.qualifier == TagQualifier {
+		return pattern
+	}
+	return term.qualifier + ":" + pattern
+}
+
+type selectorNot struct {
+	operand Selector
+}
+
+func (not selectorNot) Match(step Step) (bool, []string) {
+	matched, facts := not.operand.Match(step)
+	return !matched, facts
+}
+
+func (not selectorNot) String() string {
+	if _, ok := not.operand.(selectorTerm); ok {
+		return "!" + not.operand.String()
+	}
+	return "!(" + not.operand.String() + ")"
+}
+
+// selectorAnd matches the steps matched by all of its operands, every step when it has none.
+type selectorAnd struct {
+	operands []Selector
+}
+
+func (and selectorAnd) Match(step Step) (bool, []string) {
+	facts := []string{}
+	for _, operand := range and.operands {
+		matched, operandFacts := operand.Match(step)
+		if !matched {
+			return false, operandFacts
+		}
+		facts = append(facts, operandFacts...)
+	}
+	return true, facts
+}
+
+func (and selectorAnd) String() string {
+	operands := []string{}
+	for _, operand := range and.operands {
+		if _, ok := operand.(selectorOr); ok {
+			operands = append(operands, "("+operand.String()+")")
+		} else {
+			operands = append(operands, operand.String())
+		}
+	}
+	return strings.Join(operands, " && ")
+}
+
+type selectorOr struct {
+	operands []Selector
+}
+
+func (or selectorOr) Match(step Step) (bool, []string) {
+	facts := []string{}
+	for _, operand := range or.operands {
+		matched, operandFacts := operand.Match(step)
+		if matched {
+			return true, operandFacts
+		}
+		facts = append(facts, operandFacts...)
+	}
+	return false, facts
+}
+
+func (or selectorOr) String() string {
+	operands := []string{}
+	for _, operand := range or.operands {
+		operands = append(operands, operand.String())
+	}
+	return strings.Join(operands, " || ")
+}
+
+// tagsSelector matches the steps having a tag matching one of the included patterns, if
+// any, and none of the excluded patterns, an untagged step having the empty tag.
+type tagsSelector struct {
+	included []string
+	excluded []string
+}
+
+func (selector tagsSelector) Match(step Step) (bool, []string) {
+	if len(selector.included) == 0 && len(selector.excluded) == 0 {
+		return true, nil
+	}
+	tags := []string(step.Tags)
+	if len(tags) == 0 {
+		tags = []string{""}
+	}
+	included := "-include " + strings.Join(selector.included, ",")
+	excluded := "-exclude " + strings.Join(selector.excluded, ",")
+	facts := []string{}
+	for _, tag := range tags {
+		name := "tag " + tag
+		if tag == "" {
+			name = "no tag"
+		}
+		isIncluded := len(selector.included) == 0 || utils.MatchAtLeastOne(selector.included, tag)
+		isExcluded := len(selector.excluded) > 0 && utils.MatchAtLeastOne(selector.excluded, tag)
+		switch {
+		case isIncluded && !isExcluded && len(selector.excluded) == 0:
+			return true, []string{name + " matches " + included}
+		case isIncluded && !isExcluded && len(selector.included) == 0:
+			return true, []string{name + " doesn't match " + excluded}
+		case isIncluded && !isExcluded:
+			return true, []string{name + " matches " + included + " but not " + excluded}
+		case isIncluded:
+			facts = append(facts, name+" matches "+excluded)
+		}
+	}
+	if len(facts) == 0 {
+		facts = append(facts, "no tag matches "+included)
+	}
+	return false, facts
+}
+
+func (selector tagsSelector) String() string {
+	flags := []string{}
+	if len(selector.included) > 0 {
+		flags = append(flags, "-include "+strings.Join(selector.included, ","))
+	}
+	if len(selector.excluded) > 0 {
+		flags = append(flags, "-exclude "+strings.Join(selector.excluded, ","))
+	}
+	return strings.Join(flags, " ")
+}
+
+// TagsSelector returns the selector of the steps kept by -include and -exclude: the steps
+// having a tag matching one of the included tags, if any, and none of the excluded tags,
+// the tags possibly having wildcards. An untagged step has the empty tag, matched by *.
+func TagsSelector(included []string, excluded []string) Selector {
+	return tagsSelector{included: included, excluded: excluded}
+}
+
+// selectorToken is a token of a selector expression: an operator, a parenthesis, a word
+// or a quoted string.
+type selectorToken struct {
+	value    string
+	quoted   bool
+	position int
+}
+
+func tokenizeSelector(expression string) ([]selectorToken, error) {
+	tokens := []selectorToken{}
+	for i := 0; i < len(expression); {
+		switch c := expression[i]; {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '(' || c == ')' || c == '!':
+			tokens = append(tokens, selectorToken{value: string(c), position: i})
+			i++
+		case c == '&' || c == '|':
+			if i+1 >= len(expression) || expression[i+1] != c {
+				return nil, fmt.Errorf("unexpected %c at %d, expected %c%c", c, i+1, c, c)
+			}
+			tokens = append(tokens, selectorToken{value: expression[i : i+2], position: i})
+			i += 2
+		case c == '"':
+			end := i + 1
+			for end < len(expression) && expression[end] != '"' {
+				if expression[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(expression) {
+				return nil, fmt.Errorf("unterminated string at %d", i+1)
+			}
+			value, err := strconv.Unquote(expression[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid string at %d: %w", i+1, err)
+			}
+			tokens = append(tokens, selectorToken{value: value, quoted: true, position: i})
+			i = end + 1
+		default:
+			end := i
+			for end < len(expression) && !strings.ContainsRune(" \t()!&|\"", rune(expression[end])) {
+				end++
+			}
+			tokens = append(tokens, selectorToken{value: expression[i:end], position: i})
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+// selectorParser parses the tokens of a selector by recursive descent.
+type selectorParser struct {
+	tokens []selectorToken
+	next   int
+	length int
+}
+
+// peek returns the next token, an empty one at the end of the expression.
+func (parser *selectorParser) peek() selectorToken {
+	if parser.next < len(parser.tokens) {
+		return parser.tokens[parser.next]
+	}
+	return selectorToken{position: parser.length}
+}
+
+func (parser *selectorParser) isOperator(value string) bool {
+	token := parser.peek()
+	return !token.quoted && token.value == value
+}
+
+// or parses operands separated by ||.
+func (parser *selectorParser) or() (Selector, error) {
+	or := selectorOr{}
+	for {
+		operand, err := parser.and()
+		if err != nil {
+			return nil, err
+		}
+		or.operands = append(or.operands, operand)
+		if !parser.isOperator("||") {
+			break
+		}
+		parser.next++
+	}
+	if len(or.operands) == 1 {
+		return or.operands[0], nil
+	}
+	return or, nil
+}
+
+// and parses operands separated by &&, binding tighter than ||.
+func (parser *selectorParser) and() (Selector, error) {
+	and := selectorAnd{}
+	for {
+		operand, err := parser.unary()
+		if err != nil {
+			return nil, err
+		}
+		and.operands = append(and.operands, operand)
+		if !parser.isOperator("&&") {
+			break
+		}
+		parser.next++
+	}
+	if len(and.operands) == 1 {
+		return and.operands[0], nil
+	}
+	return and, nil
+}
+
+// unary parses a negation, an expression between parentheses or a term.
+func (parser *selectorParser) unary() (Selector, error) {
+	token := parser.peek()
+	switch {
+	case parser.isOperator("!"):
+		parser.next++
+		operand, err := parser.unary()
+		if err != nil {
+			return nil, err
+		}
+		return selectorNot{operand: operand}, nil
+	case parser.isOperator("("):
+		parser.next++
+		selector, err := parser.or()
+		if err != nil {
+			return nil, err
+		}
+		if !parser.isOperator(")") {
+			return nil, parser.unexpected("expected )")
+		}
+		parser.next++
+		return selector, nil
+	case token.value == "" && !token.quoted, parser.isOperator(")"), parser.isOperator("&&"), parser.isOperator("||"):
+		return nil, parser.unexpected("expected a tag, a qualified pattern, ! or (")
+	}
+	parser.next++
+	if token.quoted {
+		return selectorTerm{qualifier: TagQualifier, pattern: token.value}, nil
+	}
+	parts := strings.SplitN(token.value, ":", 2)
+	if len(parts) == 1 {
+		return selectorTerm{qualifier: TagQualifier, pattern: token.value}, nil
+	}
+	if !utils.Contains(selectorQualifiers, parts[0]) {
+		return nil, fmt.Errorf("unknown qualifier %s at %d, expected one of %s", parts[0], token.position+1, strings.Join(selectorQualifiers, ", "))
+	}
+	term := selectorTerm{qualifier: parts[0], pattern: parts[1]}
+	if term.pattern == "" {
+		// The pattern of a qualifier followed by a quoted string, as in name:"terraform plan".
+		if next := parser.peek(); next.quoted && next.position == token.position+len(token.value) {
+			term.pattern = next.value
+			parser.next++
+		} else {
+			return nil, fmt.Errorf("missing pattern after %s at %d", token.value, token.position+1)
+		}
+	}
+	return term, nil
+}
+
+func (parser *selectorParser) unexpected(expected string) error {
+	token := parser.peek()
+	if parser.next >= len(parser.tokens) {
+		return fmt.Errorf("unexpected end of selector, %s", expected)
+	}
+	value := token.value
+	if token.quoted {
+		value = strconv.Quote(value)
+	}
+	return fmt.Errorf("unexpected %s at %d, %s", value, token.position+1, expected)
+}
+
+// ParseSelector parses a selector expression, such as terraform && prod && !destroy:
+//   - a term matches the steps having a tag matching it, or with a qualifier, the steps
+//     whose name, project or trigger matches it, as in name:deploy-*, the terms possibly
+//     having wildcards and being quoted when they have spaces or operators;
+//   - ! negates the term or expression between parentheses following it;
+//   - && binds tighter than ||.
+func ParseSelector(expression string) (Selector, error) {
+	tokens, err := tokenizeSelector(expression)
+	if err != nil {
+		return nil, fmt.Errorf("invalid selector %q: %w", expression, err)
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("invalid selector %q: empty selector", expression)
+	}
+	parser := &selectorParser{tokens: tokens, length: len(expression)}
+	selector, err := parser.or()
+	if err == nil && parser.next < len(tokens) {
+		err = parser.unexpected("expected && or ||")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid selector %q: %w", expression, err)
+	}
+	return selector, nil
+}
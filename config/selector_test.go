@@ -0,0 +1,141 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseSelector(t *testing.T) {
+	tcs := []struct {
+		expression  string
+		expected    string
+		expectedErr string
+	}{
+		{expression: "terraform", expected: "terraform"},
+		{expression: "terraform && prod && !destroy", expected: "terraform && prod && !destroy"},
+		{expression: "a || b && c", expected: "a || b && c"},
+		{expression: "(a || b) && !(c || d)", expected: "(a || b) && !(c || d)"},
+		{expression: "name:deploy-* || project:app-*&&trigger:*-prod", expected: "name:deploy-* || project:app-* && trigger:*-prod"},
+		{expression: `name:"terraform plan" || "two words"`, expected: `name:"terraform plan" || "two words"`},
+		{expression: "", expectedErr: `invalid selector "": empty selector`},
+		{expression: "a & b", expectedErr: `invalid selector "a & b": unexpected & at 3, expected &&`},
+		{expression: "a && ", expectedErr: `invalid selector "a && ": unexpected end of selector, expected a tag, a qualified pattern, ! or (`},
+		{expression: "(a || b", expectedErr: `invalid selector "(a || b": unexpected end of selector, expected )`},
+		{expression: "a b", expectedErr: `invalid selector "a b": unexpected b at 3, expected && or ||`},
+		{expression: "a)", expectedErr: `invalid selector "a)": unexpected ) at 2, expected && or ||`},
+		{expression: "owner:me", expectedErr: `invalid selector "owner:me": unknown qualifier owner at 1, expected one of name, project, tag, trigger`},
+		{expression: "name: a", expectedErr: `invalid selector "name: a": missing pattern after name: at 1`},
+		{expression: `name:"a`, expectedErr: `invalid selector "name:\"a": unterminated string at 6`},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.expression, func(t *testing.T) {
+			selector, err := ParseSelector(tc.expression)
+			if tc.expectedErr != "" {
+				if err == nil || err.Error() != tc.expectedErr {
+					t.Fatalf("got error %v, want %s", err, tc.expectedErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := selector.String(); got != tc.expected {
+				t.Errorf("got %s, want %s", got, tc.expected)
+			}
+		})
+	}
+}
+
+func TestSelectorMatch(t *testing.T) {
+	step := Step{Name: "terraform apply", ProjectId: "infra-prod", Trigger: "tf-apply", Tags: Tags{"terraform", "prod"}}
+	tcs := []struct {
+		expression      string
+		expected        bool
+		expectedReasons []string
+	}{
+		{
+			expression:      "terraform && prod && !destroy",
+			expected:        true,
+			expectedReasons: []string{"tag terraform matches terraform", "tag prod matches prod", "no tag matches destroy"},
+		},
+		{
+			expression:      "terraform && !prod",
+			expected:        false,
+			expectedReasons: []string{"tag prod matches prod"},
+		},
+		{
+			expression:      "dev || staging",
+			expected:        false,
+			expectedReasons: []string{"no tag matches dev", "no tag matches staging"},
+		},
+		{
+			expression:      "terra* && project:*-prod",
+			expected:        true,
+			expectedReasons: []string{"tag terraform matches terra*", `project "infra-prod" matches project:*-prod`},
+		},
+		{
+			expression:      `name:"terraform plan" || trigger:tf-*`,
+			expected:        true,
+			expectedReasons: []string{`trigger "tf-apply" matches trigger:tf-*`},
+		},
+		{
+			expression:      `name:"terraform plan"`,
+			expected:        false,
+			expectedReasons: []string{`name "terraform apply" doesn't match name:"terraform plan"`},
+		},
+		{
+			expression:      "tag:prod",
+			expected:        true,
+			expectedReasons: []string{"tag prod matches prod"},
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.expression, func(t *testing.T) {
+			selector, err := ParseSelector(tc.expression)
+			if err != nil {
+				t.Fatal(err)
+			}
+			matched, reasons := selector.Match(step)
+			if matched != tc.expected {
+				t.Errorf("got %v, want %v", matched, tc.expected)
+			}
+			if d := cmp.Diff(tc.expectedReasons, reasons); d != "" {
+				t.Errorf("unexpected reasons (-want, +got): %s", d)
+			}
+		})
+	}
+}
+
+func TestTagsSelector(t *testing.T) {
+	tcs := []struct {
+		name     string
+		included []string
+		excluded []string
+		tags     Tags
+		expected bool
+	}{
+		{name: "no tags", tags: nil, expected: true},
+		{name: "included", included: []string{"a", "b*"}, tags: Tags{"c", "bc"}, expected: true},
+		{name: "not included", included: []string{"a"}, tags: Tags{"b"}, expected: false},
+		{name: "excluded", excluded: []string{"a"}, tags: Tags{"a"}, expected: false},
+		{name: "one tag not excluded", excluded: []string{"a"}, tags: Tags{"a", "b"}, expected: true},
+		{name: "included and excluded", included: []string{"b"}, excluded: []string{"b"}, tags: Tags{"a", "b"}, expected: false},
+		{name: "one included tag not excluded", included: []string{"terraform"}, excluded: []string{"destroy"}, tags: Tags{"terraform", "destroy"}, expected: true},
+		{name: "included tag excluded", included: []string{"terraform", "destroy"}, excluded: []string{"destroy"}, tags: Tags{"destroy", "prod"}, expected: false},
+		{name: "untagged included by wildcard", included: []string{"*"}, tags: nil, expected: true},
+		{name: "untagged not included", included: []string{"a"}, tags: nil, expected: false},
+		{name: "untagged excluded by wildcard", excluded: []string{"*"}, tags: nil, expected: false},
+		{name: "untagged not excluded", excluded: []string{"a"}, tags: nil, expected: true},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			if matched, _ := TagsSelector(tc.included, tc.excluded).Match(Step{Tags: tc.tags}); matched != tc.expected {
+				t.Errorf("got %v, want %v", matched, tc.expected)
+			}
+		})
+	}
+}
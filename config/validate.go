@@ -0,0 +1,336 @@
+package config
+
+import (
+	"cork/dag"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// yamlSections names the sections of a config file decoded into each type.
+var yamlSections = map[string]string{
+	"Config":      "config",
+	"Step":        "step",
+	"RetryPolicy": "retry",
+}
+
+var (
+	yamlErrorRegex    = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+	unknownFieldRegex = regexp.MustCompile(`^field (\S+) not found in type config\.(\w+)$`)
+)
+
+// Problem is an error found at a line of a config file, line 0 meaning the whole file.
+type Problem struct {
+	File    string
+	Line    int
+	Message string
+}
+
+func (problem Problem) Error() string {
+	if problem.Line == 0 {
+		return problem.File + ": " + problem.Message
+	}
+	return fmt.Sprintf("%s:%d: %s", problem.File, problem.Line, problem.Message)
+}
+
+// yamlProblems converts the errors of the yaml decoder, one per line when there are several.
+func yamlProblems(path string, err error) []Problem {
+	messages := []string{err.Error()}
+	if typeErr, ok := err.(*yaml.TypeError); ok {
+		messages = typeErr.Errors
+	}
+	problems := []Problem{}
+	for _, message := range messages {
+		problem := Problem{File: path, Message: message}
+		if match := yamlErrorRegex.FindStringSubmatch(message); match != nil {
+			problem.Line, _ = strconv.Atoi(match[1])
+			problem.Message = match[2]
+		}
+		if match := unknownFieldRegex.FindStringSubmatch(problem.Message); match != nil {
+			problem.Message = "unknown key " + match[1]
+			if section, ok := yamlSections[match[2]]; ok {
+				problem.Message += " in " + section
+			}
+		}
+		problems = append(problems, problem)
+	}
+	return problems
+}
+
+// mappingValue returns the key and value nodes of key in a mapping node, nil if absent.
+func mappingValue(node *yaml.Node, key string) (*yaml.Node, *yaml.Node) {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil, nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i], node.Content[i+1]
+		}
+	}
+	return nil, nil
+}
+
+// stepNodes returns the nodes of the steps of a config document.
+func stepNodes(document *yaml.Node) []*yaml.Node {
+	if document.Kind == yaml.DocumentNode && len(document.Content) > 0 {
+		document = document.Content[0]
+	}
+	_, steps := mappingValue(document, "steps")
+	if steps == nil || steps.Kind != yaml.SequenceNode {
+		return nil
+	}
+	return steps.Content
+}
+
+// keyNode returns the node of key in the step node, or the step node itself.
+func keyNode(stepNode *yaml.Node, key string) *yaml.Node {
+	if node, _ := mappingValue(stepNode, key); node != nil {
+		return node
+	}
+	return stepNode
+}
+
+// configFile is a config file decoded for validation.
+type configFile struct {
+	path   string
+	source *source
+	config Config
+	// nodes are the yaml nodes of the steps, with their templates resolved.
+	nodes []*yaml.Node
+	// definedAt are the nodes naming the valid steps.
+	definedAt  map[string]*yaml.Node
+	validSteps []Step
+}
+
+// decodeConfigFile decodes the config file resolved with overrides, see Unmarshal,
+// returning nil along with the problems preventing its steps from being checked.
+func decodeConfigFile(path string, overrides Overrides) (*configFile, []Problem) {
+	source, problems := loadSource(path, overrides)
+	if source == nil {
+		return nil, problems
+	}
+	file := &configFile{path: path, source: source, definedAt: map[string]*yaml.Node{}}
+	// Decoding errors are reported by loadSource in the file they come from.
+	source.root.Decode(&file.config)
+	file.nodes = stepNodes(source.root)
+	if len(file.nodes) != len(file.config.Steps) {
+		// The steps couldn't be decoded, their problems are already reported.
+		return nil, problems
+	}
+	return file, problems
+}
+
+// problem returns a problem at the node of key in the i-th step, or at the step.
+func (file *configFile) problem(i int, key string, message string) Problem {
+	return file.source.problem(keyNode(file.nodes[i], key), message)
+}
+
+// dependencyProblem returns a problem at the j-th dependency of the i-th step.
+func (file *configFile) dependencyProblem(i int, j int, message string) Problem {
+	_, dependsOn := mappingValue(file.nodes[i], "depends-on")
+	if dependsOn != nil && dependsOn.Kind == yaml.SequenceNode && j < len(dependsOn.Content) {
+		return file.source.problem(dependsOn.Content[j], message)
+	}
+	return file.source.problem(file.nodes[i], message)
+}
+
+// retryProblems returns the problems of the retry policy of the i-th step, at its retry key.
+func (file *configFile) retryProblems(i int, step Step) []Problem {
+	if step.Retry == nil {
+		return nil
+	}
+	problems := []Problem{}
+	for _, message := range step.Retry.Check(step.Name) {
+		problems = append(problems, file.problem(i, "retry", message))
+	}
+	return problems
+}
+
+// checkSteps returns the problems of the steps of the file, dependencies on steps of
+// otherConfigs being checked by checkExternalDependencies.
+func (file *configFile) checkSteps(otherConfigs []string) []Problem {
+	problems := []Problem{}
+	for i, step := range file.config.Steps {
+		if step.Name == "" {
+			problems = append(problems, file.source.problem(file.nodes[i], "step without a name"))
+			continue
+		}
+		if step.Trigger == "" {
+			problems = append(problems, file.problem(i, "trigger", "step "+step.Name+" has an empty trigger"))
+		}
+		if step.ProjectId == "" {
+			problems = append(problems, file.problem(i, "project-id", "step "+step.Name+" has an empty project-id"))
+		}
+		problems = append(problems, file.retryProblems(i, step)...)
+		if first, ok := file.definedAt[step.Name]; ok {
+			position := fmt.Sprintf("line %d", first.Line)
+			if origin := file.source.origins[first]; origin != file.source.origins[keyNode(file.nodes[i], "name")] {
+				position = fmt.Sprintf("%s:%d", origin, first.Line)
+			}
+			problems = append(problems, file.problem(i, "name", "duplicate step name "+step.Name+", first defined at "+position))
+			continue
+		}
+		file.definedAt[step.Name] = keyNode(file.nodes[i], "name")
+		file.validSteps = append(file.validSteps, step)
+	}
+
+	// Links are added one by one, in the order of the file, so that each cycle is
+	// reported at the dependency closing it.
+	d, _ := dag.BuildDag(Steps(file.validSteps), nil)
+	for i, step := range file.config.Steps {
+		if _, ok := file.definedAt[step.Name]; !ok {
+			continue
+		}
+		for j, dependency := range step.DependsOn {
+			if configName, _ := SplitDependency(dependency, otherConfigs); configName != "" {
+				continue
+			}
+			if _, ok := file.definedAt[dependency]; !ok {
+				problems = append(problems, file.dependencyProblem(i, j, "step "+step.Name+" depends on undefined step "+dependency))
+				continue
+			}
+			if err := d.AddLink(dependency, step.Name); err != nil {
+				problems = append(problems, file.dependencyProblem(i, j, fmt.Sprintf("step %s can't depend on %s: %s", step.Name, dependency, dagError(err))))
+			}
+		}
+	}
+	return problems
+}
+
+// checkExternalDependencies returns the problems of the dependencies between the steps
+// of different files: dependencies on undefined steps and cycles spanning several configs.
+func checkExternalDependencies(files []*configFile) []Problem {
+	configs := []Config{}
+	byName := map[string]*configFile{}
+	for _, file := range files {
+		configs = append(configs, file.config)
+		byName[file.config.Name] = file
+	}
+
+	// The links within each config are added first as their cycles are already reported.
+	steps := qualifiedSteps{}
+	links := map[string][]string{}
+	for _, file := range files {
+		otherConfigs := OtherConfigNames(configs, file.config.Name)
+		for _, step := range file.validSteps {
+			key := QualifiedName(file.config.Name, step.Name)
+			steps = append(steps, qualifiedStep{Step: step, key: key})
+			for _, dependency := range step.DependsOn {
+				if configName, _ := SplitDependency(dependency, otherConfigs); configName == "" {
+					links[key] = append(links[key], QualifiedName(file.config.Name, dependency))
+				}
+			}
+		}
+	}
+	d, err := dag.BuildDag(steps, links)
+	if err != nil {
+		// Problems within a config prevent checking the links between configs.
+		return nil
+	}
+
+	problems := []Problem{}
+	for _, file := range files {
+		otherConfigs := OtherConfigNames(configs, file.config.Name)
+		for i, step := range file.config.Steps {
+			// Steps without a name and duplicates of a name are left out.
+			if node, ok := file.definedAt[step.Name]; !ok || node != keyNode(file.nodes[i], "name") {
+				continue
+			}
+			key := QualifiedName(file.config.Name, step.Name)
+			for j, dependency := range step.DependsOn {
+				configName, stepName := SplitDependency(dependency, otherConfigs)
+				if configName == "" {
+					continue
+				}
+				if _, ok := byName[configName].definedAt[stepName]; !ok {
+					problems = append(problems, file.dependencyProblem(i, j, "step "+step.Name+" depends on undefined step "+stepName+" of "+configName))
+					continue
+				}
+				if err := d.AddLink(QualifiedName(configName, stepName), key); err != nil {
+					problems = append(problems, file.dependencyProblem(i, j, fmt.Sprintf("step %s can't depend on %s: %s", step.Name, dependency, dagError(err))))
+				}
+			}
+		}
+	}
+	return problems
+}
+
+// Validate checks the config files meant to be run together and returns every problem
+// found in them: unknown keys, steps without a name, trigger or project-id, duplicate
+// step or config names, undefined variables, templates or profiles, invalid retry policies,
+// dependencies on undefined steps and dependency cycles, within a config or across configs.
+func Validate(paths []string, overrides Overrides) []Problem {
+	problems := []Problem{}
+	files := []*configFile{}
+	for _, path := range paths {
+		file, fileProblems := decodeConfigFile(path, overrides)
+		problems = append(problems, fileProblems...)
+		if file != nil {
+			files = append(files, file)
+		}
+	}
+
+	configs := []Config{}
+	namedAt := map[string]string{}
+	for _, file := range files {
+		configs = append(configs, file.config)
+		if first, ok := namedAt[file.config.Name]; ok {
+			problem := Problem{File: file.path, Message: "duplicate config name " + file.config.Name + ", also used by " + first}
+			if name, _ := mappingValue(file.source.root, "name"); name != nil {
+				problem = file.source.problem(name, problem.Message)
+			}
+			problems = append(problems, problem)
+			continue
+		}
+		namedAt[file.config.Name] = file.path
+	}
+	for _, file := range files {
+		problems = append(problems, file.checkSteps(OtherConfigNames(configs, file.config.Name))...)
+	}
+	if len(namedAt) == len(files) {
+		problems = append(problems, checkExternalDependencies(files)...)
+	}
+
+	// Problems are sorted by file, the config files first and the files they include
+	// next, and by line. Files included by several configs report their problems once.
+	order := map[string]int{}
+	sources := append([]string{}, paths...)
+	for _, file := range files {
+		sources = append(sources, file.source.files...)
+	}
+	for _, path := range sources {
+		if _, ok := order[path]; !ok {
+			order[path] = len(order)
+		}
+	}
+	sort.SliceStable(problems, func(i, j int) bool {
+		if problems[i].File != problems[j].File {
+			return order[problems[i].File] < order[problems[j].File]
+		}
+		return problems[i].Line < problems[j].Line
+	})
+	unique := []Problem{}
+	seen := map[Problem]bool{}
+	for _, problem := range problems {
+		if !seen[problem] {
+			seen[problem] = true
+			unique = append(unique, problem)
+		}
+	}
+	return unique
+}
+
+// dagError returns the innermost message of a dag.BuildDag error.
+func dagError(err error) error {
+	for {
+		unwrapped := errors.Unwrap(err)
+		if unwrapped == nil {
+			return err
+		}
+		err = unwrapped
+	}
+}
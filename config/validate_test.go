@@ -0,0 +1,258 @@
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "cork.yaml")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestValidate(t *testing.T) {
+	tcs := []struct {
+		name     string
+		content  string
+		expected []string
+	}{
+		{
+			name: "valid",
+			content: `name: demo
+steps:
+  - name: a
+    trigger: a
+    project-id: p
+  - name: b
+    trigger: b
+    project-id: p
+    depends-on:
+      - a
+`,
+			expected: []string{},
+		},
+		{
+			name: "unknown keys",
+			content: `name: demo
+descripton: typo
+steps:
+  - name: a
+    trigger: a
+    projectid: p
+    depend-on:
+      - b
+`,
+			expected: []string{
+				"2: unknown key descripton in config",
+				"4: step a has an empty project-id",
+				"6: unknown key projectid in step",
+				"7: unknown key depend-on in step",
+			},
+		},
+		{
+			name: "steps",
+			content: `name: demo
+steps:
+  - name: a
+    trigger: ""
+    project-id: p
+  - trigger: b
+    project-id: p
+  - name: a
+    trigger: a
+    project-id: p
+  - name: c
+    trigger: c
+    project-id: p
+    depends-on:
+      - a
+      - undefined
+`,
+			expected: []string{
+				"4: step a has an empty trigger",
+				"6: step without a name",
+				"8: duplicate step name a, first defined at line 3",
+				"16: step c depends on undefined step undefined",
+			},
+		},
+		{
+			name: "cycle",
+			content: `name: demo
+steps:
+  - name: a
+    trigger: a
+    project-id: p
+    depends-on:
+      - b
+  - name: b
+    trigger: b
+    project-id: p
+    depends-on:
+      - a
+`,
+			expected: []string{"12: step b can't depend on a: cycle detected: [b a b]"},
+		},
+		{
+			name: "steps extending templates",
+			content: `name: demo
+templates:
+  deploy:
+    trigger: deploy
+    project-id: p
+steps:
+  - name: a
+    extends: deploy
+  - name: b
+    extends: deploy
+    project-id: ""
+`,
+			expected: []string{"11: step b has an empty project-id"},
+		},
+		{
+			name: "retry policies",
+			content: `name: demo
+steps:
+  - name: a
+    trigger: a
+    project-id: p
+    retry:
+      max-attempts: -1
+  - name: b
+    trigger: b
+    project-id: p
+    retry:
+      max-attempts: 2
+      on: [FAILURE, SUCCESS]
+  - name: c
+    trigger: c
+    project-id: p
+    retry:
+      max-attempts: 3
+      on: [TIMEOUT, CANCELLED]
+`,
+			expected: []string{
+				"6: the retry of step a must have max-attempts of at least 1, not -1",
+				"11: the retry of step b can't be on SUCCESS, only on FAILURE, INTERNAL_ERROR, TIMEOUT, CANCELLED, EXPIRED",
+			},
+		},
+		{
+			name:     "syntax error",
+			content:  "name: demo\nsteps:\n  - name: [a\n",
+			expected: []string{"2: did not find expected ',' or ']'"},
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			path := writeConfig(t, tc.content)
+			problems := []string{}
+			for _, problem := range Validate([]string{path}, Overrides{}) {
+				problems = append(problems, problem.Error()[len(path)+1:])
+			}
+			if d := cmp.Diff(tc.expected, problems); d != "" {
+				t.Errorf("unexpected problems (-want, +got): %s", d)
+			}
+		})
+	}
+}
+
+func TestUnmarshalUnknownKeys(t *testing.T) {
+	path := writeConfig(t, "name: demo\nsteps:\n  - name: a\n    depend-on: [b]\n")
+	_, err := Unmarshal(path, Overrides{})
+	expected := path + ":4: unknown key depend-on in step"
+	if err == nil || err.Error() != expected {
+		t.Errorf("got error %v, want %s", err, expected)
+	}
+}
+
+func TestValidateSeveralConfigs(t *testing.T) {
+	platform := `name: platform
+steps:
+  - name: network
+    trigger: network
+    project-id: p
+    depends-on:
+      - app:build
+`
+	tcs := []struct {
+		name     string
+		platform string
+		app      string
+		expected []string
+	}{
+		{
+			name:     "valid",
+			platform: platform,
+			app: `name: app
+steps:
+  - name: build
+    trigger: build
+    project-id: p
+  - name: deploy
+    trigger: deploy
+    project-id: p
+    depends-on:
+      - platform:network
+`,
+			expected: []string{},
+		},
+		{
+			name:     "undefined step of another config",
+			platform: platform,
+			app: `name: app
+steps:
+  - name: build
+    trigger: build
+    project-id: p
+    depends-on:
+      - platform:subnet
+`,
+			expected: []string{"app:7: step build depends on undefined step subnet of platform"},
+		},
+		{
+			name:     "cycle across configs",
+			platform: platform,
+			app: `name: app
+steps:
+  - name: build
+    trigger: build
+    project-id: p
+    depends-on:
+      - platform:network
+`,
+			expected: []string{"app:7: step build can't depend on platform:network: cycle detected: [app:build platform:network app:build]"},
+		},
+		{
+			name:     "duplicate config name",
+			platform: platform,
+			app:      "name: platform\nsteps: []\n",
+			expected: []string{
+				"platform:7: step network depends on undefined step app:build",
+				"app:1: duplicate config name platform, also used by platform",
+			},
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			platformPath, appPath := writeConfig(t, tc.platform), writeConfig(t, tc.app)
+			names := map[string]string{platformPath: "platform", appPath: "app"}
+			problems := []string{}
+			for _, problem := range Validate([]string{platformPath, appPath}, Overrides{}) {
+				message := strings.ReplaceAll(problem.Error()[len(problem.File):], platformPath, "platform")
+				problems = append(problems, names[problem.File]+message)
+			}
+			if d := cmp.Diff(tc.expected, problems); d != "" {
+				t.Errorf("unexpected problems (-want, +got): %s", d)
+			}
+		})
+	}
+}
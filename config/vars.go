@@ -0,0 +1,166 @@
+package config
+
+import (
+	"cork/utils"
+	"os"
+	"regexp"
+
+	"gopkg.in/yaml.v3"
+)
+
+// variableRegex matches the variables interpolated in the configs, ${NAME}, and their
+// escaped form $${NAME} kept as ${NAME}. References to the outputs of steps, such as
+// ${steps.build.outputs.image}, don't match as they contain dots.
+var variableRegex = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// interpolatedKeys are the keys whose values are interpolated, in the config and in its steps.
+// A variable in the value of another key is a problem, except in the keys of the config
+// holding the vars and the steps, templates and profiles, whose values are interpolated
+// once in the steps.
+var interpolatedKeys = map[string][]string{
+	"config": {"description", "region", "substitutions"},
+	"step":   {"trigger", "project-id", "description", "region", "substitutions", "labels", "depends-on"},
+}
+
+var uninterpolatedConfigKeys = []string{"vars", "steps", "templates", "profiles"}
+
+// variables resolves the variables of a config: those given on the command line first,
+// then the environment and finally the vars of the config.
+type variables struct {
+	overrides map[string]string
+	vars      map[string]string
+}
+
+func (v variables) lookup(name string) (string, bool) {
+	if value, ok := v.overrides[name]; ok {
+		return value, true
+	}
+	if value, ok := os.LookupEnv(name); ok {
+		return value, true
+	}
+	value, ok := v.vars[name]
+	return value, ok
+}
+
+// interpolate replaces the variables in the values of the config and of its steps,
+// returning a problem for every occurrence of an undefined variable.
+func (s *source) interpolate(overrides map[string]string) []Problem {
+	v := variables{overrides: overrides, vars: map[string]string{}}
+	if _, vars := mappingValue(s.root, "vars"); vars != nil && vars.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(vars.Content); i += 2 {
+			v.vars[vars.Content[i].Value] = vars.Content[i+1].Value
+		}
+	}
+	problems := []Problem{}
+	seen := map[Problem]bool{}
+	replace := func(node *yaml.Node, value string) string {
+		return variableRegex.ReplaceAllStringFunc(value, func(match string) string {
+			if match[1] == '$' {
+				return match[1:]
+			}
+			name := variableRegex.FindStringSubmatch(match)[1]
+			resolved, ok := v.lookup(name)
+			if !ok {
+				// Values shared by the steps extending a template are reported once.
+				if problem := s.problem(node, "undefined variable "+name); !seen[problem] {
+					seen[problem] = true
+					problems = append(problems, problem)
+				}
+				return match
+			}
+			return resolved
+		})
+	}
+	s.interpolateKeys(s.root, interpolatedKeys["config"], replace)
+	problems = append(problems, s.uninterpolatedProblems(s.root, append(interpolatedKeys["config"], uninterpolatedConfigKeys...), seen)...)
+	if _, steps := mappingValue(s.root, "steps"); steps != nil && steps.Kind == yaml.SequenceNode {
+		for _, step := range steps.Content {
+			s.interpolateKeys(step, interpolatedKeys["step"], replace)
+			problems = append(problems, s.uninterpolatedProblems(step, interpolatedKeys["step"], seen)...)
+		}
+	}
+	return problems
+}
+
+// uninterpolatedProblems returns a problem for every variable in the values of the keys
+// of the mapping other than interpolated, once for the values shared through templates.
+func (s *source) uninterpolatedProblems(mapping *yaml.Node, interpolated []string, seen map[Problem]bool) []Problem {
+	if mapping.Kind != yaml.MappingNode {
+		return nil
+	}
+	problems := []Problem{}
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		key := mapping.Content[i].Value
+		if utils.Contains(interpolated, key) {
+			continue
+		}
+		for _, node := range scalarNodes(mapping.Content[i+1]) {
+			for _, match := range variableRegex.FindAllString(node.Value, -1) {
+				if match[1] == '$' {
+					continue
+				}
+				if problem := s.problem(node, "variables aren't interpolated in the "+key+", as "+match); !seen[problem] {
+					seen[problem] = true
+					problems = append(problems, problem)
+				}
+			}
+		}
+	}
+	return problems
+}
+
+// interpolateKeys replaces the values of the keys of the mapping by their copies
+// interpolated by replace, the values being possibly shared with the templates of
+// other steps.
+func (s *source) interpolateKeys(mapping *yaml.Node, keys []string, replace func(*yaml.Node, string) string) {
+	if mapping.Kind != yaml.MappingNode {
+		return
+	}
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		for _, key := range keys {
+			if mapping.Content[i].Value == key {
+				mapping.Content[i+1] = s.interpolated(mapping.Content[i+1], replace)
+			}
+		}
+	}
+}
+
+// interpolated returns a copy of the node with its scalar values replaced by replace.
+func (s *source) interpolated(node *yaml.Node, replace func(*yaml.Node, string) string) *yaml.Node {
+	copied := *node
+	s.origins[&copied] = s.origins[node]
+	switch node.Kind {
+	case yaml.ScalarNode:
+		copied.Value = replace(node, node.Value)
+	case yaml.SequenceNode:
+		copied.Content = []*yaml.Node{}
+		for _, item := range node.Content {
+			copied.Content = append(copied.Content, s.interpolated(item, replace))
+		}
+	case yaml.MappingNode:
+		copied.Content = []*yaml.Node{}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			copied.Content = append(copied.Content, node.Content[i], s.interpolated(node.Content[i+1], replace))
+		}
+	}
+	return &copied
+}
+
+// scalarNodes returns the scalar values under the node, the node itself for a scalar.
+func scalarNodes(node *yaml.Node) []*yaml.Node {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		return []*yaml.Node{node}
+	case yaml.MappingNode:
+		scalars := []*yaml.Node{}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			scalars = append(scalars, scalarNodes(node.Content[i+1])...)
+		}
+		return scalars
+	}
+	scalars := []*yaml.Node{}
+	for _, child := range node.Content {
+		scalars = append(scalars, scalarNodes(child)...)
+	}
+	return scalars
+}
@@ -0,0 +1,135 @@
+package config
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+const variablesConfig = `name: deployment
+description: Deployment to ${ENV}
+region: ${REGION}
+vars:
+  ENV: dev
+  PROJECT: app-dev
+  REGION: europe-west1
+substitutions:
+  _REGION: ${REGION}
+templates:
+  deploy:
+    project-id: ${PROJECT}
+steps:
+  - name: build
+    trigger: build-${ENV}
+    project-id: ${PROJECT}
+    region: ${ENV}-${REGION}
+  - name: deploy
+    extends: deploy
+    trigger: deploy-${ENV}
+    depends-on:
+      - ${BUILD_STEP}
+    substitutions:
+      _IMAGE: ${steps.build.outputs.image}
+      _LITERAL: $${ENV}
+`
+
+func TestUnmarshalVariables(t *testing.T) {
+	t.Setenv("BUILD_STEP", "build")
+	t.Setenv("PROJECT", "app-env")
+	dir := writeFiles(t, map[string]string{"cork.yaml": variablesConfig})
+
+	config, err := Unmarshal(filepath.Join(dir, "cork.yaml"), Overrides{Vars: map[string]string{"ENV": "prod"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Config{
+		ConfigFile:    filepath.Join(dir, "cork.yaml"),
+		Name:          "deployment",
+		Description:   "Deployment to prod",
+		Region:        "europe-west1",
+		Substitutions: map[string]string{"_REGION": "europe-west1"},
+		Steps: []Step{
+			{Name: "build", Trigger: "build-prod", ProjectId: "app-env", Region: "prod-europe-west1"},
+			{
+				Name:      "deploy",
+				Trigger:   "deploy-prod",
+				ProjectId: "app-env",
+				DependsOn: []string{"build"},
+				Substitutions: map[string]string{
+					"_IMAGE":   "${steps.build.outputs.image}",
+					"_LITERAL": "${ENV}",
+				},
+			},
+		},
+	}
+	if d := cmp.Diff(expected, config); d != "" {
+		t.Errorf("unexpected config (-want, +got): %s", d)
+	}
+}
+
+func TestUnmarshalUndefinedVariables(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"cork.yaml": `name: demo
+templates:
+  deploy:
+    project-id: ${CORK_TEST_PROJECT}
+steps:
+  - name: a
+    extends: deploy
+    trigger: ${CORK_TEST_PREFIX}-${CORK_TEST_ENV}
+  - name: b
+    extends: deploy
+    trigger: b
+`,
+	})
+
+	_, err := Unmarshal(filepath.Join(dir, "cork.yaml"), Overrides{})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	expected := []string{
+		"cork.yaml:4: undefined variable CORK_TEST_PROJECT",
+		"cork.yaml:8: undefined variable CORK_TEST_PREFIX",
+		"cork.yaml:8: undefined variable CORK_TEST_ENV",
+	}
+	problems := strings.Split(strings.ReplaceAll(err.Error(), dir+"/", ""), "\n")
+	if d := cmp.Diff(expected, problems); d != "" {
+		t.Errorf("unexpected problems (-want, +got): %s", d)
+	}
+}
+
+func TestUnmarshalUninterpolatedVariables(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"cork.yaml": `name: ${CORK_TEST_NAME}
+vars:
+  ENV: dev
+templates:
+  deploy:
+    tags:
+      - ${ENV}
+steps:
+  - name: a
+    extends: deploy
+    trigger: a-${ENV}
+  - name: b
+    extends: deploy
+    trigger: b
+    tags: $${ENV}
+`,
+	})
+
+	_, err := Unmarshal(filepath.Join(dir, "cork.yaml"), Overrides{})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	expected := []string{
+		"cork.yaml:1: variables aren't interpolated in the name, as ${CORK_TEST_NAME}",
+		"cork.yaml:7: variables aren't interpolated in the tags, as ${ENV}",
+	}
+	problems := strings.Split(strings.ReplaceAll(err.Error(), dir+"/", ""), "\n")
+	if d := cmp.Diff(expected, problems); d != "" {
+		t.Errorf("unexpected problems (-want, +got): %s", d)
+	}
+}
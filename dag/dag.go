@@ -3,6 +3,7 @@ package dag
 import (
 	"errors"
 	"fmt"
+	"sort"
 	"strings"
 )
 
@@ -56,6 +57,15 @@ func (dag *Dag) addDirectedLink(previousTask string, nextTask string) error {
 	return nil
 }
 
+// AddLink makes the task next depend on the task previous, failing if previous isn't
+// in the dag or if the link would create a cycle.
+func (dag *Dag) AddLink(previous string, next string) error {
+	if _, ok := dag.Nodes[next]; !ok {
+		return fmt.Errorf("task %s wasn't present in the Dag", next)
+	}
+	return dag.addDirectedLink(previous, next)
+}
+
 func linkTasks(prev *Node, next *Node) error {
 	// Check for self cycle
 	if prev.Task.GetKey() == next.Task.GetKey() {
@@ -115,8 +125,7 @@ func (dag *Dag) traverseAndAnnotateSchedulable(n *Node, nodeSchedulableMap map[s
 	schedulable := true
 	if !n.Task.HasFinished() && !n.Task.HasStarted() {
 		for _, prev := range n.Prev {
-			if _, ok := nodeSchedulableMap[prev.Task.GetKey()]; ok && !dag.Nodes[prev.Task.GetKey()].Task.HasFinished() &&
-				!dag.Nodes[prev.Task.GetKey()].Task.IsSuccessful() {
+			if _, ok := nodeSchedulableMap[prev.Task.GetKey()]; ok && !dag.Nodes[prev.Task.GetKey()].Task.IsSuccessful() {
 				schedulable = false
 				break
 			}
@@ -124,9 +133,12 @@ func (dag *Dag) traverseAndAnnotateSchedulable(n *Node, nodeSchedulableMap map[s
 	} else if n.Task.HasStarted() && !n.Task.HasFinished() {
 		schedulable = false
 	} else {
-		for _, prev := range n.Prev {
-			if !dag.Nodes[prev.Task.GetKey()].Task.HasFinished() {
-				return fmt.Errorf("task %s depends on %s but %s hasn't finished yet", n.Task.GetKey(), prev.Task.GetKey(), prev.Task.GetKey())
+		// Unsuccessful tasks may finish early, e.g. when skipped because another dependency failed.
+		if n.Task.IsSuccessful() {
+			for _, prev := range n.Prev {
+				if !dag.Nodes[prev.Task.GetKey()].Task.HasFinished() {
+					return fmt.Errorf("task %s depends on %s but %s hasn't finished yet", n.Task.GetKey(), prev.Task.GetKey(), prev.Task.GetKey())
+				}
 			}
 		}
 		schedulable = false
@@ -161,6 +173,59 @@ func (dag *Dag) GetNodesToSchedule() ([]string, error) {
 	return schedulableNodes, nil
 }
 
+// GetDescendants returns the sorted keys of every task depending, directly or
+// transitively, on the task key.
+func (dag *Dag) GetDescendants(key string) []string {
+	descendants := []string{}
+	node, ok := dag.Nodes[key]
+	if !ok {
+		return descendants
+	}
+	visited := map[string]bool{}
+	toVisit := append([]*Node{}, node.Next...)
+	for len(toVisit) > 0 {
+		current := toVisit[0]
+		toVisit = toVisit[1:]
+		if visited[current.Task.GetKey()] {
+			continue
+		}
+		visited[current.Task.GetKey()] = true
+		descendants = append(descendants, current.Task.GetKey())
+		toVisit = append(toVisit, current.Next...)
+	}
+	sort.Strings(descendants)
+	return descendants
+}
+
+// GetWaves returns the tasks grouped in waves of topological order: the tasks of a
+// wave only depend on tasks of the previous waves. Each wave is sorted.
+func (dag *Dag) GetWaves() [][]string {
+	waves := [][]string{}
+	remainingPrev := map[string]int{}
+	wave := []string{}
+	for key, node := range dag.Nodes {
+		remainingPrev[key] = len(node.Prev)
+		if len(node.Prev) == 0 {
+			wave = append(wave, key)
+		}
+	}
+	for len(wave) > 0 {
+		sort.Strings(wave)
+		waves = append(waves, wave)
+		nextWave := []string{}
+		for _, key := range wave {
+			for _, next := range dag.Nodes[key].Next {
+				remainingPrev[next.Task.GetKey()]--
+				if remainingPrev[next.Task.GetKey()] == 0 {
+					nextWave = append(nextWave, next.Task.GetKey())
+				}
+			}
+		}
+		wave = nextWave
+	}
+	return waves
+}
+
 func findLinks(node *Node, nextMap map[string][]string) {
 	for _, next := range node.Next {
 		nextMap[node.Task.GetKey()] = append(nextMap[node.Task.GetKey()], "<"+next.Task.GetKey()+">")
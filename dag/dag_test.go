@@ -30,7 +30,7 @@ func (tt testTask) GetKey() string {
 }
 
 func (tt testTask) HasFinished() bool {
-	return tt.status == "done"
+	return tt.status == "done" || tt.status == "failed"
 }
 
 func (tt testTask) IsSuccessful() bool {
@@ -236,6 +236,25 @@ func TestBuildDagInvalid(t *testing.T) {
 	}
 }
 
+func TestAddLink(t *testing.T) {
+	d, err := BuildDag(testTaskList([]testTask{{name: "a"}, {name: "b"}}), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.AddLink("a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.AddLink("b", "a"); err == nil || !strings.Contains(err.Error(), "cycle detected: [a b a]") {
+		t.Errorf("expected a cycle error, got %v", err)
+	}
+	if err := d.AddLink("w", "a"); err == nil {
+		t.Error("expected an error for a missing task")
+	}
+	if len(d.Nodes["a"].Prev) != 0 || len(d.Nodes["b"].Prev) != 1 {
+		t.Error("expected the failed links not to be added")
+	}
+}
+
 func TestGetSchedulable(t *testing.T) {
 	tcs := []struct {
 		name          string
@@ -372,6 +391,101 @@ func TestGetSchedulableInvalid(t *testing.T) {
 	}
 }
 
+func TestGetSchedulableWithFailures(t *testing.T) {
+	tcs := []struct {
+		name          string
+		finished      []string
+		failed        []string
+		expectedTasks []string
+	}{
+		{
+			name:          "a-failed",
+			failed:        []string{"a"},
+			expectedTasks: []string{"u", "x"},
+		}, {
+			name:          "a-x-done-y-failed",
+			finished:      []string{"a", "x"},
+			failed:        []string{"y"},
+			expectedTasks: []string{"u"},
+		}, {
+			name:          "y-failed-b-z-skipped",
+			finished:      []string{"a", "x"},
+			failed:        []string{"y", "b", "z", "v", "w"},
+			expectedTasks: []string{"u"},
+		},
+	}
+	for _, tc := range tcs {
+		d := buildTestDag(t)
+		t.Run(tc.name, func(t *testing.T) {
+			for _, task := range tc.finished {
+				taskT := d.Nodes[task].Task.(testTask)
+				taskT.status = "done"
+				d.Nodes[task].Task = taskT
+			}
+			for _, task := range tc.failed {
+				taskT := d.Nodes[task].Task.(testTask)
+				taskT.status = "failed"
+				d.Nodes[task].Task = taskT
+			}
+			tasks, err := d.GetNodesToSchedule()
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if d := cmp.Diff(tasks, tc.expectedTasks, cmpopts.SortSlices(func(a string, b string) bool { return a < b })); d != "" {
+				t.Errorf("expected that with %v failed, %v would be ready to schedule but was different: %s", tc.failed, tc.expectedTasks, PrintWantGot(t, d))
+			}
+		})
+	}
+}
+
+func TestGetDescendants(t *testing.T) {
+	tcs := []struct {
+		name     string
+		task     string
+		expected []string
+	}{
+		{
+			name:     "leaf",
+			task:     "w",
+			expected: []string{},
+		}, {
+			name:     "root",
+			task:     "a",
+			expected: []string{"b", "v", "w", "y", "z"},
+		}, {
+			name:     "middle",
+			task:     "y",
+			expected: []string{"b", "v", "w", "z"},
+		}, {
+			name:     "unknown",
+			task:     "unknown",
+			expected: []string{},
+		},
+	}
+	d := buildTestDag(t)
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			if diff := cmp.Diff(tc.expected, d.GetDescendants(tc.task)); diff != "" {
+				t.Errorf("unexpected descendants of %s: %s", tc.task, PrintWantGot(t, diff))
+			}
+		})
+	}
+}
+
+func TestGetWaves(t *testing.T) {
+	d := buildTestDag(t)
+	expected := [][]string{
+		{"a", "u", "x"},
+		{"y"},
+		{"b", "z"},
+		{"v"},
+		{"w"},
+	}
+	if diff := cmp.Diff(expected, d.GetWaves()); diff != "" {
+		t.Errorf("unexpected waves: %s", PrintWantGot(t, diff))
+	}
+}
+
 func PrintWantGot(t *testing.T, diff string) string {
 	t.Helper()
 	return fmt.Sprintf("(-want, +got): %s", diff)
@@ -0,0 +1,111 @@
+package flow
+
+import (
+	"cork/config"
+	"cork/gcp"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type trackedBuild struct {
+	Step      string
+	ProjectId string
+	Region    string
+	BuildId   string
+	Trigger   string
+	LogUrl    string
+}
+
+// buildTracker keeps the builds started by a run until they reach a final status.
+type buildTracker struct {
+	lock    sync.Mutex
+	aborted bool
+	builds  map[string]trackedBuild
+}
+
+func newBuildTracker() *buildTracker {
+	return &buildTracker{builds: map[string]trackedBuild{}}
+}
+
+// add tracks a build and returns false if the run was aborted in the meantime,
+// in which case the build has to be cancelled by the caller.
+func (t *buildTracker) add(build trackedBuild) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.aborted {
+		return false
+	}
+	t.builds[build.BuildId] = build
+	return true
+}
+
+func (t *buildTracker) remove(buildId string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.builds, buildId)
+}
+
+// abort returns the builds in flight and prevents new ones from being tracked.
+func (t *buildTracker) abort() []trackedBuild {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.aborted = true
+	builds := []trackedBuild{}
+	for _, build := range t.builds {
+		builds = append(builds, build)
+	}
+	t.builds = map[string]trackedBuild{}
+	sort.Slice(builds, func(i, j int) bool { return builds[i].Trigger < builds[j].Trigger })
+	return builds
+}
+
+func cancelBuild(ctx *executionContext, build trackedBuild) error {
+	err := ctx.backend.CancelBuild(build.ProjectId, build.Region, build.BuildId)
+	if err != nil {
+		flowLog(Log{
+			Trigger:  build.Trigger,
+			Message:  "could not be cancelled: " + err.Error(),
+			LogUrl:   build.LogUrl,
+			Progress: gcp.FAILURE,
+		})
+		return err
+	}
+	func() {
+		ctx.lock.Lock()
+		defer ctx.lock.Unlock()
+		node := ctx.dag.Nodes[build.Step]
+		step := node.Task.(config.Step)
+		step.Status = config.ABORTED
+		node.Task = step
+	}()
+	flowLog(Log{
+		Trigger:  build.Trigger,
+		Message:  "cancelled",
+		LogUrl:   build.LogUrl,
+		Progress: gcp.CANCELLED,
+	})
+	return nil
+}
+
+// cancelBuilds aborts the run and cancels every build still in flight.
+func cancelBuilds(ctx *executionContext) {
+	ctx.abort()
+	cancelled, notCancelled := []string{}, []string{}
+	for _, build := range ctx.builds.abort() {
+		if err := cancelBuild(ctx, build); err != nil {
+			notCancelled = append(notCancelled, "\t"+build.Trigger+" ("+build.BuildId+"): "+err.Error())
+		} else {
+			cancelled = append(cancelled, "\t"+build.Trigger+" ("+build.BuildId+")")
+		}
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(cancelled) > 0 {
+		fmt.Printf("# %s cancelled builds:\n%s\n", ctx.conf.Name, strings.Join(cancelled, "\n"))
+	}
+	if len(notCancelled) > 0 {
+		fmt.Printf("# %s builds that could not be cancelled:\n%s\n", ctx.conf.Name, strings.Join(notCancelled, "\n"))
+	}
+}
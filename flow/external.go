@@ -0,0 +1,151 @@
+package flow
+
+import (
+	"cork/config"
+)
+
+// externalDependency is a step of another run that a step depends on.
+type externalDependency struct {
+	// name is the dependency as written in the config, as in platform:network apply.
+	name string
+	ctx  *executionContext
+	key  string
+}
+
+// externalDependencies returns the dependencies of the step on steps of the other configs.
+func externalDependencies(step config.Step, otherConfigs []string) []string {
+	dependencies := []string{}
+	for _, dependency := range step.DependsOn {
+		if configName, _ := config.SplitDependency(dependency, otherConfigs); configName != "" {
+			dependencies = append(dependencies, dependency)
+		}
+	}
+	return dependencies
+}
+
+// linkRuns lets the steps depending on steps of other configs wait for them, and the
+// runs they depend on wake them up when steps finish.
+func linkRuns(ctxs []*executionContext) {
+	configs := []config.Config{}
+	byName := map[string]*executionContext{}
+	for _, ctx := range ctxs {
+		configs = append(configs, *ctx.conf)
+		byName[ctx.conf.Name] = ctx
+	}
+	for _, ctx := range ctxs {
+		otherConfigs := config.OtherConfigNames(configs, ctx.conf.Name)
+		for _, step := range ctx.conf.Steps {
+			for _, dependency := range externalDependencies(step, otherConfigs) {
+				configName, stepName := config.SplitDependency(dependency, otherConfigs)
+				upstream := byName[configName]
+				ctx.external[step.Name] = append(ctx.external[step.Name], externalDependency{
+					name: dependency,
+					ctx:  upstream,
+					key:  stepName,
+				})
+				upstream.addDependent(ctx)
+			}
+		}
+	}
+}
+
+// linkRunsOf adds to linked the runs linked to ctx by dependencies between their configs,
+// directly or not, ctx included.
+func linkRunsOf(ctx *executionContext, linked map[*executionContext]bool) {
+	if linked[ctx] {
+		return
+	}
+	linked[ctx] = true
+	for _, dependent := range ctx.dependents {
+		linkRunsOf(dependent, linked)
+	}
+	for _, dependencies := range ctx.external {
+		for _, dependency := range dependencies {
+			linkRunsOf(dependency.ctx, linked)
+		}
+	}
+}
+
+func (ctx *executionContext) addDependent(dependent *executionContext) {
+	for _, known := range ctx.dependents {
+		if known == dependent {
+			return
+		}
+	}
+	ctx.dependents = append(ctx.dependents, dependent)
+}
+
+// notifyDependents wakes up the runs depending on steps of the run, without blocking
+// as a single pending notification is enough for them to look at every step again.
+func notifyDependents(ctx *executionContext) {
+	for _, dependent := range ctx.dependents {
+		select {
+		case dependent.changes <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// runFinished tells whether the run ended, its steps not started yet never being run.
+func runFinished(ctx *executionContext) bool {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	return ctx.finished
+}
+
+// externalReadiness values tell whether a step can start as far as its dependencies on other runs go.
+const (
+	externalReady = iota
+	externalWaiting
+	externalFailed
+)
+
+// externalReadiness returns the readiness of every step depending on steps of other runs,
+// along with the dependency that didn't succeed for the failed ones. It must be called
+// without holding the lock of ctx, the locks of the other runs being taken.
+func externalReadiness(ctx *executionContext) (map[string]int, map[string]string) {
+	readiness := map[string]int{}
+	failures := map[string]string{}
+	for key, dependencies := range ctx.external {
+		readiness[key] = externalReady
+		for _, dependency := range dependencies {
+			// The run is looked at first as its steps don't change anymore once it finished.
+			finished := runFinished(dependency.ctx)
+			upstream := getStep(dependency.ctx, dependency.key)
+			switch {
+			case upstream.IsSuccessful():
+			case upstream.HasFinished() || finished:
+				readiness[key] = externalFailed
+				failures[key] = dependency.name
+			case readiness[key] == externalReady:
+				readiness[key] = externalWaiting
+			}
+			if readiness[key] == externalFailed {
+				break
+			}
+		}
+	}
+	return readiness, failures
+}
+
+// waitingOnExternal tells whether steps of the run didn't start yet because of steps of other runs.
+func waitingOnExternal(ctx *executionContext) bool {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	for key := range ctx.external {
+		if !ctx.dag.Nodes[key].Task.HasStarted() {
+			return true
+		}
+	}
+	return false
+}
+
+// getDependency returns the step a step depends on, in the run or in another run.
+func getDependency(ctx *executionContext, stepName string, dependency string) config.Step {
+	for _, external := range ctx.external[stepName] {
+		if external.name == dependency {
+			return getStep(external.ctx, external.key)
+		}
+	}
+	return getStep(ctx, dependency)
+}
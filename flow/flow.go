@@ -1,23 +1,80 @@
 package flow
 
 import (
+	"context"
 	"cork/cmd"
 	"cork/config"
 	"cork/dag"
+	"cork/gcp"
 	"fmt"
-	"log"
+	"os"
+	"os/signal"
 	"strings"
 	"sync"
+	"syscall"
 )
 
-func Execute(configs []config.Config, options cmd.Options) {
-	wg := sync.WaitGroup{}
-	defer wg.Wait()
-	for _, c := range configs {
-		d, err := dag.BuildDag(config.Steps(c.Steps), c.GetLinks())
+// runConfigs returns the configs of the run states.
+func runConfigs(states []*RunState) []config.Config {
+	configs := []config.Config{}
+	for _, state := range states {
+		configs = append(configs, state.Config)
+	}
+	return configs
+}
+
+// Execute runs the configs of the run states concurrently, within a shared budget of
+// parallel jobs, the steps depending on steps of other configs waiting for them. It
+// prints their summary and returns the process exit code matching the worst outcome
+// among them.
+func Execute(states []*RunState, options cmd.Options, backend gcp.Backend) int {
+	// Interrupting cork aborts every run, which cancels the builds they started.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	configs := runConfigs(states)
+	if _, err := config.BuildDag(configs); err != nil && len(configs) > 1 {
+		fmt.Println(err)
+		return ExitOrchestrationError
+	}
+
+	workers := make(chan struct{}, options.NumParallelJobs)
+	runCtxs := []*executionContext{}
+	for _, state := range states {
+		c := state.Config
+		d, err := dag.BuildDag(config.Steps(c.Steps), c.GetLinks(config.OtherConfigNames(configs, c.Name)...))
 		if err != nil {
-			log.Fatal(err)
+			fmt.Printf("# %s: %s\n", c.Name, err)
+			return ExitOrchestrationError
 		}
+		runCtx := newExecutionContext(ctx, d, &state.Config, options, backend)
+		runCtx.state = state
+		runCtx.workers = workers
+		runCtx.exactRef = state.CommitSha
+		runCtx.options.Reference = state.Reference
+		runCtx.options.Substitutions = state.Substitutions
+		runCtxs = append(runCtxs, runCtx)
+	}
+	linkRuns(runCtxs)
+
+	// No build is started unless every run passes its preflight.
+	preflightFailed := false
+	for _, runCtx := range runCtxs {
+		if err := preflight(runCtx); err != nil {
+			fmt.Printf("# %s preflight failed:\n%s\n", runCtx.conf.Name, err)
+			preflightFailed = true
+		}
+	}
+	if preflightFailed {
+		return ExitOrchestrationError
+	}
+
+	codes := make([]int, len(runCtxs))
+	wg := sync.WaitGroup{}
+	for i, state := range states {
+		runCtx := runCtxs[i]
+		c := state.Config
+		d := runCtx.dag
 		fmt.Printf("# %s:\n", c.Name)
 		fmt.Print(d)
 		manualStep := []string{}
@@ -30,10 +87,38 @@ func Execute(configs []config.Config, options cmd.Options) {
 		if len(manualStep) > 0 {
 			fmt.Println("Manual steps:\n" + strings.Join(manualStep, "\n"))
 		}
+		fmt.Println("Run state: " + state.Path())
 		wg.Add(1)
-		go func(conf config.Config) {
+		go func(i int) {
 			defer wg.Done()
-			run(d, &conf, options)
-		}(c)
+			codes[i] = run(runCtxs[i])
+		}(i)
+	}
+	wg.Wait()
+
+	printSummary(runCtxs)
+	code := ExitSuccess
+	// A run is resumed along with the runs its config is linked to, for its dependencies
+	// on their steps.
+	linked := map[*executionContext]bool{}
+	for i, runCtx := range runCtxs {
+		code = worstExitCode(code, codes[i])
+		if codes[i] != ExitSuccess {
+			linkRunsOf(runCtx, linked)
+		}
+	}
+	resumable := []string{}
+	for _, runCtx := range runCtxs {
+		if linked[runCtx] {
+			resumable = append(resumable, runCtx.state.Path())
+		}
+	}
+	if len(resumable) > 0 {
+		command := "cork resume "
+		if options.Rehearse {
+			command += "-rehearse "
+		}
+		fmt.Println("Resume with: " + command + strings.Join(resumable, " "))
 	}
+	return code
 }
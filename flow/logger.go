@@ -27,12 +27,21 @@ type WaitInput struct {
 
 var (
 	lock sync.Mutex
+	// inputLock serializes the prompts without holding back the other messages.
+	inputLock sync.Mutex
 
 	cloudBuildLoggerFunctions = map[string]logMessageFunc{
-		gcp.SUCCESS:   successMessage,
-		gcp.FAILURE:   errorMessage,
-		gcp.RUNNING:   progressMessage,
-		gcp.CANCELLED: cancelledMessage,
+		gcp.SUCCESS:        successMessage,
+		gcp.FAILURE:        errorMessage,
+		gcp.RUNNING:        progressMessage,
+		gcp.CANCELLED:      cancelledMessage,
+		gcp.STATUS_UNKNOWN: unknownMessage,
+		gcp.PENDING:        pendingMessage,
+		gcp.QUEUED:         queuedMessage,
+		gcp.WORKING:        workingMessage,
+		gcp.INTERNAL_ERROR: internalErrorMessage,
+		gcp.TIMEOUT:        timeoutMessage,
+		gcp.EXPIRED:        expiredMessage,
 	}
 )
 
@@ -46,6 +55,7 @@ var (
 	cancelledLabel    = color.Yellow.Render
 	errorLabel        = color.Red.Render
 	runningLabel      = color.Blue.Render
+	queuedLabel       = color.Cyan.Render
 	skipLabel         = color.Yellow.Render
 	waitingInputLabel = color.Magenta.Render
 	contextText       = color.White.Render
@@ -53,28 +63,45 @@ var (
 
 type logMessageFunc func(trigger string, message string, url string)
 
-func errorMessage(trigger string, message string, url string) {
+func printMessage(label string, trigger string, message string, url string) {
 	fmt.Printf(
 		"%s %s %s %s\n",
-		errorLabel("[   ERROR   ]"),
+		label,
 		contextText("["+trigger+"]"),
 		message,
 		urlLink(url),
 	)
+}
+
+func alert(trigger string) {
 	err := beep.Alert("ERROR", trigger, "assets/warning.png")
 	if err != nil {
 		fmt.Println(err.Error())
 	}
 }
 
+func errorMessage(trigger string, message string, url string) {
+	printMessage(errorLabel("[   ERROR   ]"), trigger, message, url)
+	alert(trigger)
+}
+
+func internalErrorMessage(trigger string, message string, url string) {
+	printMessage(errorLabel("[ INT ERROR ]"), trigger, message, url)
+	alert(trigger)
+}
+
+func timeoutMessage(trigger string, message string, url string) {
+	printMessage(errorLabel("[  TIMEOUT  ]"), trigger, message, url)
+	alert(trigger)
+}
+
+func expiredMessage(trigger string, message string, url string) {
+	printMessage(errorLabel("[  EXPIRED  ]"), trigger, message, url)
+	alert(trigger)
+}
+
 func successMessage(trigger string, message string, url string) {
-	fmt.Printf(
-		"%s %s %s %s\n",
-		successLabel("[  SUCCESS  ]"),
-		contextText("["+trigger+"]"),
-		message,
-		urlLink(url),
-	)
+	printMessage(successLabel("[  SUCCESS  ]"), trigger, message, url)
 	err := beep.Notify("SUCCESS", trigger, "assets/information.png")
 	if err != nil {
 		fmt.Println(err.Error())
@@ -82,23 +109,27 @@ func successMessage(trigger string, message string, url string) {
 }
 
 func progressMessage(trigger string, message string, url string) {
-	fmt.Printf(
-		"%s %s %s %s\n",
-		runningLabel("[  RUNNING  ]"),
-		contextText("["+trigger+"]"),
-		message,
-		urlLink(url),
-	)
+	printMessage(runningLabel("[  RUNNING  ]"), trigger, message, url)
+}
+
+func workingMessage(trigger string, message string, url string) {
+	printMessage(runningLabel("[  WORKING  ]"), trigger, message, url)
+}
+
+func pendingMessage(trigger string, message string, url string) {
+	printMessage(queuedLabel("[  PENDING  ]"), trigger, message, url)
+}
+
+func queuedMessage(trigger string, message string, url string) {
+	printMessage(queuedLabel("[  QUEUED   ]"), trigger, message, url)
+}
+
+func unknownMessage(trigger string, message string, url string) {
+	printMessage(cancelledLabel("[  UNKNOWN  ]"), trigger, message, url)
 }
 
 func cancelledMessage(trigger string, message string, url string) {
-	fmt.Printf(
-		"%s %s %s %s\n",
-		cancelledLabel("[ CANCELLED ]"),
-		contextText("["+trigger+"]"),
-		message,
-		urlLink(url),
-	)
+	printMessage(cancelledLabel("[ CANCELLED ]"), trigger, message, url)
 }
 
 func skipAppMessage(message string) {
@@ -110,18 +141,22 @@ func skipAppMessage(message string) {
 }
 
 func waitForInput(waitInput WaitInput) bool {
-	defer lock.Unlock()
-	lock.Lock()
+	defer inputLock.Unlock()
+	inputLock.Lock()
 
 	var s string
 
-	fmt.Printf(
-		"%s %s %s %s (y/N):",
-		waitingInputLabel("[  WAITING  ]"),
-		contextText("["+waitInput.Trigger+"]"),
-		waitInput.Message,
-		urlLink(waitInput.LogUrl),
-	)
+	func() {
+		defer lock.Unlock()
+		lock.Lock()
+		fmt.Printf(
+			"%s %s %s %s (y/N):",
+			waitingInputLabel("[  WAITING  ]"),
+			contextText("["+waitInput.Trigger+"]"),
+			waitInput.Message,
+			urlLink(waitInput.LogUrl),
+		)
+	}()
 	scanner := bufio.NewScanner(os.Stdin)
 	if scanner.Scan() {
 		s = scanner.Text()
@@ -0,0 +1,129 @@
+package flow
+
+import (
+	"cork/config"
+	"cork/dag"
+	"cork/utils"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// outputReferenceRegex matches the ${steps.STEP.outputs.OUTPUT} references to the outputs of upstream steps.
+var outputReferenceRegex = regexp.MustCompile(`\$\{steps\.(.+?)\.outputs\.([^}]+)\}`)
+
+func sortedKeys(values map[string]string) []string {
+	keys := []string{}
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ReferencedOutputs returns the outputs of the steps of conf referenced by the substitutions
+// of the config, of its steps and by overrides, by step name.
+func ReferencedOutputs(conf config.Config, overrides map[string]string) map[string][]string {
+	layers := []map[string]string{conf.Substitutions, overrides}
+	for _, step := range conf.Steps {
+		layers = append(layers, step.Substitutions)
+	}
+	referenced := map[string][]string{}
+	for _, substitutions := range layers {
+		for _, value := range substitutions {
+			for _, match := range outputReferenceRegex.FindAllStringSubmatch(value, -1) {
+				if !utils.Contains(referenced[match[1]], match[2]) {
+					referenced[match[1]] = append(referenced[match[1]], match[2])
+				}
+			}
+		}
+	}
+	return referenced
+}
+
+// checkOutputReference checks that step can reference the outputs of referenced, that is depends on it.
+func checkOutputReference(d *dag.Dag, step config.Step, referenced string) error {
+	if _, ok := d.Nodes[referenced]; !ok {
+		return fmt.Errorf("%s references the outputs of %s which isn't part of the run", step.Name, referenced)
+	}
+	if !utils.Contains(d.GetDescendants(referenced), step.Name) {
+		return fmt.Errorf("%s references the outputs of %s which it doesn't depend on", step.Name, referenced)
+	}
+	return nil
+}
+
+// checkOutputReferences checks every reference to the outputs of other steps in substitutions.
+func checkOutputReferences(d *dag.Dag, step config.Step, substitutions map[string]string) error {
+	problems := []string{}
+	for _, key := range sortedKeys(substitutions) {
+		for _, match := range outputReferenceRegex.FindAllStringSubmatch(substitutions[key], -1) {
+			if err := checkOutputReference(d, step, match[1]); err != nil {
+				problems = append(problems, err.Error())
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// resolveOutputs replaces the references to the outputs of upstream steps in substitutions
+// by their values, failing if any of them is missing.
+func resolveOutputs(d *dag.Dag, step config.Step, substitutions map[string]string) (map[string]string, error) {
+	if substitutions == nil {
+		return nil, nil
+	}
+	problems := []string{}
+	resolved := map[string]string{}
+	for _, key := range sortedKeys(substitutions) {
+		resolved[key] = outputReferenceRegex.ReplaceAllStringFunc(substitutions[key], func(reference string) string {
+			match := outputReferenceRegex.FindStringSubmatch(reference)
+			referenced, output := match[1], match[2]
+			if err := checkOutputReference(d, step, referenced); err != nil {
+				problems = append(problems, err.Error())
+				return reference
+			}
+			outputs := d.Nodes[referenced].Task.(config.Step).Outputs
+			value, ok := outputs[output]
+			if !ok {
+				problem := fmt.Sprintf("%s references the output %s of %s which doesn't exist", step.Name, output, referenced)
+				if len(outputs) > 0 {
+					problem += " (outputs: " + strings.Join(sortedKeys(outputs), ", ") + ")"
+				}
+				problems = append(problems, problem)
+				return reference
+			}
+			return value
+		})
+	}
+	if len(problems) > 0 {
+		return nil, errors.New(strings.Join(problems, ", "))
+	}
+	return resolved, nil
+}
+
+// stepSubstitutions returns the substitutions the trigger of step is run with, with
+// the outputs of upstream steps resolved.
+func stepSubstitutions(ctx *executionContext, step config.Step) (map[string]string, error) {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	return resolveOutputs(ctx.dag, step, runSubstitutions(ctx.conf, step, ctx.options.Substitutions, ctx.triggers))
+}
+
+// collectOutputs records the outputs of the successful build of step.
+func collectOutputs(ctx *executionContext, step *config.Step, buildId string, triggerName string) {
+	outputs, err := ctx.backend.GetBuildOutputs(step.ProjectId, ctx.conf.GetRegion(*step), buildId)
+	if err != nil {
+		flowLog(Log{Trigger: triggerName, Message: "couldn't get the build outputs: " + err.Error(), Progress: SKIP})
+	}
+	if outputs == nil {
+		outputs = map[string]string{}
+	}
+	if outputs["commit_sha"] == "" && step.CommitSha != "" {
+		outputs["commit_sha"] = step.CommitSha
+	}
+	step.Outputs = outputs
+}
@@ -0,0 +1,94 @@
+package flow
+
+import (
+	"cork/config"
+	"cork/dag"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestResolveOutputs(t *testing.T) {
+	build := testStep("build")
+	build.Outputs = map[string]string{"image_digest": "sha256:abc", "commit_sha": "0123456"}
+	steps := []config.Step{build, testStep("other"), testStep("deploy", "build")}
+	d, err := dag.BuildDag(config.Steps(steps), config.Config{Steps: steps}.GetLinks())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tcs := []struct {
+		name          string
+		substitutions map[string]string
+		expected      map[string]string
+		expectedErr   string
+	}{
+		{
+			name:          "no reference",
+			substitutions: map[string]string{"_ENV": "prod"},
+			expected:      map[string]string{"_ENV": "prod"},
+		},
+		{
+			name: "references",
+			substitutions: map[string]string{
+				"_DIGEST": "${steps.build.outputs.image_digest}",
+				"_TAG":    "api-${steps.build.outputs.commit_sha}",
+			},
+			expected: map[string]string{"_DIGEST": "sha256:abc", "_TAG": "api-0123456"},
+		},
+		{
+			name:          "missing output",
+			substitutions: map[string]string{"_VERSION": "${steps.build.outputs.version}"},
+			expectedErr:   "deploy references the output version of build which doesn't exist (outputs: commit_sha, image_digest)",
+		},
+		{
+			name:          "independent step",
+			substitutions: map[string]string{"_DIGEST": "${steps.other.outputs.image_digest}"},
+			expectedErr:   "deploy references the outputs of other which it doesn't depend on",
+		},
+		{
+			name:          "unknown step",
+			substitutions: map[string]string{"_DIGEST": "${steps.unknown.outputs.image_digest}"},
+			expectedErr:   "deploy references the outputs of unknown which isn't part of the run",
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			resolved, err := resolveOutputs(d, d.Nodes["deploy"].Task.(config.Step), tc.substitutions)
+			if tc.expectedErr != "" {
+				if err == nil || err.Error() != tc.expectedErr {
+					t.Fatalf("got error %v, want %s", err, tc.expectedErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tc.expected, resolved); diff != "" {
+				t.Errorf("unexpected substitutions (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestReferencedOutputs(t *testing.T) {
+	deploy := testStep("deploy", "build")
+	deploy.Substitutions = map[string]string{
+		"_IMAGE": "${steps.build.outputs.image}@${steps.build.outputs.image_digest}",
+		"_SHA":   "${steps.build.outputs.image_digest}",
+	}
+	conf := config.Config{
+		Substitutions: map[string]string{"_MANIFEST": "${steps.package.outputs.artifact_manifest}"},
+		Steps:         []config.Step{testStep("build"), testStep("package"), deploy},
+	}
+	expected := map[string][]string{
+		"build":   {"image", "image_digest", "build_step_outputs.0"},
+		"package": {"artifact_manifest"},
+	}
+	got := ReferencedOutputs(conf, map[string]string{"_OUTPUT": "${steps.build.outputs.build_step_outputs.0}"})
+	if diff := cmp.Diff(expected, got, cmpopts.SortSlices(func(a string, b string) bool { return a < b })); diff != "" {
+		t.Errorf("unexpected referenced outputs (-want +got):\n%s", diff)
+	}
+}
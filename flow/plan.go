@@ -0,0 +1,106 @@
+package flow
+
+import (
+	"cork/config"
+	"cork/dag"
+	"cork/gcp"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+func describeSource(source gcp.RepoSource) string {
+	if source.CommitSha != "" {
+		return "commit " + source.CommitSha
+	}
+	return "branch " + source.BranchName + ", pinned to the commit of the first build"
+}
+
+func describeSubstitutions(substitutions map[string]string) string {
+	pairs := []string{}
+	for key, value := range substitutions {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return "with " + strings.Join(pairs, ", ")
+}
+
+// planStep describes how a step of d would be run with the trigger triggerFullName and substitutions,
+// and the problem preventing it, if any.
+func planStep(d *dag.Dag, step config.Step, triggerFullName string, substitutions map[string]string, triggers map[string]*gcp.BuildTrigger) (string, string) {
+	description := step.Name + ": " + triggerFullName
+	if step.Manual {
+		description = "[manual] " + description
+	}
+	if step.IsSuccessful() {
+		return description + " (already done)", ""
+	}
+	if step.BuildId != "" {
+		return description + " (reattach to build " + step.BuildId + ")", ""
+	}
+	if triggers[triggerFullName] != nil && len(substitutions) > 0 {
+		description += " " + describeSubstitutions(substitutions)
+	}
+	problems := checkStep(d, step, triggerFullName, substitutions, triggers)
+	if len(problems) > 0 {
+		return description, step.Name + ": " + strings.Join(problems, ", ")
+	}
+	return description, ""
+}
+
+// planConfig prints the plan of the run state, otherConfigs being the names of the configs run along.
+func planConfig(d *dag.Dag, state *RunState, otherConfigs []string, backend gcp.Backend) []string {
+	triggers, err := listTriggers(&state.Config, d, backend)
+	if err != nil {
+		fmt.Printf("# %s: %s\n", state.Config.Name, err)
+		return []string{err.Error()}
+	}
+	ref := getRef(state.Reference, state.CommitSha)
+
+	fmt.Printf("# %s plan:\n", state.Config.Name)
+	fmt.Println("Source: " + describeSource(getSourceRepo(ref)))
+	problems := []string{}
+	for i, wave := range d.GetWaves() {
+		fmt.Printf("Wave %d:\n", i+1)
+		for _, key := range wave {
+			step := d.Nodes[key].Task.(config.Step)
+			substitutions := runSubstitutions(&state.Config, step, state.Substitutions, triggers)
+			description, problem := planStep(d, step, state.Config.GetTriggerKey(step), substitutions, triggers)
+			if external := externalDependencies(step, otherConfigs); len(external) > 0 && !step.HasStarted() {
+				description += " after " + strings.Join(external, ", ")
+			}
+			fmt.Println("\t" + description)
+			if problem != "" {
+				problems = append(problems, "\t"+problem)
+			}
+		}
+	}
+	if len(problems) > 0 {
+		fmt.Println("Problems:\n" + strings.Join(problems, "\n"))
+	}
+	return problems
+}
+
+// Plan prints what running the configs of the run states would trigger, wave by wave,
+// without triggering anything. It returns ExitOrchestrationError if a step can't be run.
+func Plan(states []*RunState, backend gcp.Backend) int {
+	code := ExitSuccess
+	configs := runConfigs(states)
+	if _, err := config.BuildDag(configs); err != nil && len(configs) > 1 {
+		fmt.Println(err)
+		code = ExitOrchestrationError
+	}
+	for _, state := range states {
+		otherConfigs := config.OtherConfigNames(configs, state.Config.Name)
+		d, err := dag.BuildDag(config.Steps(state.Config.Steps), state.Config.GetLinks(otherConfigs...))
+		if err != nil {
+			fmt.Printf("# %s: %s\n", state.Config.Name, err)
+			code = ExitOrchestrationError
+			continue
+		}
+		if problems := planConfig(d, state, otherConfigs, backend); len(problems) > 0 {
+			code = ExitOrchestrationError
+		}
+	}
+	return code
+}
@@ -0,0 +1,119 @@
+package flow
+
+import (
+	"cork/config"
+	"cork/dag"
+	"cork/gcp"
+	"testing"
+)
+
+func TestPlanStep(t *testing.T) {
+	triggers := map[string]*gcp.BuildTrigger{
+		testProject + "/enabled":  {Name: "enabled"},
+		testProject + "/disabled": {Name: "disabled", Disabled: true},
+		testProject + "/deploy":   {Name: "deploy", Substitutions: map[string]string{"_ENV": "dev", "_DIGEST": "none"}},
+		testProject + "/release":  {Name: "release", Substitutions: map[string]string{"_VERSION": ""}},
+	}
+	steps := []config.Step{testStep("build"), testStep("other"), testStep("a", "build")}
+	d, err := dag.BuildDag(config.Steps(steps), config.Config{Steps: steps}.GetLinks())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcs := []struct {
+		name                string
+		step                config.Step
+		substitutions       map[string]string
+		expectedDescription string
+		expectedProblem     string
+	}{
+		{
+			name:                "enabled",
+			step:                config.Step{Name: "a", ProjectId: testProject, Trigger: "enabled"},
+			expectedDescription: "a: test-project/enabled",
+		},
+		{
+			name:                "manual",
+			step:                config.Step{Name: "a", ProjectId: testProject, Trigger: "enabled", Manual: true},
+			expectedDescription: "[manual] a: test-project/enabled",
+		},
+		{
+			name:                "disabled",
+			step:                config.Step{Name: "a", ProjectId: testProject, Trigger: "disabled"},
+			expectedDescription: "a: test-project/disabled",
+			expectedProblem:     "a: trigger test-project/disabled is disabled",
+		},
+		{
+			name:                "missing",
+			step:                config.Step{Name: "a", ProjectId: testProject, Trigger: "missing"},
+			expectedDescription: "a: test-project/missing",
+			expectedProblem:     "a: no trigger matching test-project/missing found",
+		},
+		{
+			name:                "already done",
+			step:                config.Step{Name: "a", ProjectId: testProject, Trigger: "missing", Status: gcp.SUCCESS},
+			expectedDescription: "a: test-project/missing (already done)",
+		},
+		{
+			name:                "substitutions",
+			step:                config.Step{Name: "a", ProjectId: testProject, Trigger: "deploy"},
+			substitutions:       map[string]string{"_ENV": "prod"},
+			expectedDescription: "a: test-project/deploy with _ENV=prod",
+		},
+		{
+			name:                "undeclared substitutions",
+			step:                config.Step{Name: "a", ProjectId: testProject, Trigger: "deploy"},
+			substitutions:       map[string]string{"_ENV": "prod", "_TAG": "v1", "_IMAGE": "api"},
+			expectedDescription: "a: test-project/deploy with _ENV=prod, _IMAGE=api, _TAG=v1",
+			expectedProblem:     "a: trigger deploy doesn't declare the substitutions _IMAGE, _TAG",
+		},
+		{
+			name:                "substitution declared without default",
+			step:                config.Step{Name: "a", ProjectId: testProject, Trigger: "release"},
+			expectedDescription: "a: test-project/release",
+		},
+		{
+			name:                "upstream output",
+			step:                config.Step{Name: "a", ProjectId: testProject, Trigger: "deploy", DependsOn: []string{"build"}},
+			substitutions:       map[string]string{"_DIGEST": "${steps.build.outputs.image_digest}"},
+			expectedDescription: "a: test-project/deploy with _DIGEST=${steps.build.outputs.image_digest}",
+		},
+		{
+			name:                "output of an independent step",
+			step:                config.Step{Name: "a", ProjectId: testProject, Trigger: "deploy", DependsOn: []string{"build"}},
+			substitutions:       map[string]string{"_DIGEST": "${steps.other.outputs.image_digest}"},
+			expectedDescription: "a: test-project/deploy with _DIGEST=${steps.other.outputs.image_digest}",
+			expectedProblem:     "a: a references the outputs of other which it doesn't depend on",
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			description, problem := planStep(d, tc.step, tc.step.ProjectId+"/"+tc.step.Trigger, tc.substitutions, triggers)
+			if description != tc.expectedDescription {
+				t.Errorf("got description %q, want %q", description, tc.expectedDescription)
+			}
+			if problem != tc.expectedProblem {
+				t.Errorf("got problem %q, want %q", problem, tc.expectedProblem)
+			}
+		})
+	}
+}
+
+func TestPlanDoesNotTrigger(t *testing.T) {
+	backend := gcp.NewFakeBackend()
+	backend.AddTrigger(testProject, "a-trigger")
+	state := &RunState{
+		Reference: "develop",
+		Config: config.Config{
+			Name:  "test",
+			Steps: []config.Step{testStep("a"), testStep("b", "a")},
+		},
+	}
+
+	if code := Plan([]*RunState{state}, backend); code != ExitOrchestrationError {
+		t.Errorf("got exit code %d, want %d", code, ExitOrchestrationError)
+	}
+	if runs := backend.Runs(); len(runs) != 0 {
+		t.Errorf("expected no build to be triggered, got %v", runs)
+	}
+}
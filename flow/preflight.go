@@ -0,0 +1,170 @@
+package flow
+
+import (
+	"cork/config"
+	"cork/dag"
+	"cork/gcp"
+	"cork/utils"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// refFilter is a branch or tag regular expression filtering the pushes a trigger runs on.
+type refFilter struct {
+	pattern string
+	invert  bool
+}
+
+func triggerRefFilters(buildTrigger *gcp.BuildTrigger) []refFilter {
+	filters := []refFilter{}
+	if template := buildTrigger.TriggerTemplate; template != nil {
+		for _, pattern := range []string{template.BranchName, template.TagName} {
+			if pattern != "" {
+				filters = append(filters, refFilter{pattern: pattern, invert: template.InvertRegex})
+			}
+		}
+	}
+	if github := buildTrigger.Github; github != nil && github.Push != nil {
+		for _, pattern := range []string{github.Push.Branch, github.Push.Tag} {
+			if pattern != "" {
+				filters = append(filters, refFilter{pattern: pattern, invert: github.Push.InvertRegex})
+			}
+		}
+	}
+	return filters
+}
+
+// checkRefFilters warns when ref, a branch or a tag, doesn't match the filters of the trigger.
+func checkRefFilters(buildTrigger *gcp.BuildTrigger, ref string) string {
+	if buildTrigger == nil {
+		return ""
+	}
+	if matched, _ := regexp.MatchString(gitShaRegex, ref); matched {
+		return ""
+	}
+	filters := triggerRefFilters(buildTrigger)
+	if len(filters) == 0 {
+		return ""
+	}
+	patterns := []string{}
+	for _, filter := range filters {
+		matched, err := regexp.MatchString(filter.pattern, ref)
+		if err == nil && matched != filter.invert {
+			return ""
+		}
+		patterns = append(patterns, filter.pattern)
+	}
+	return fmt.Sprintf("reference %s doesn't match %s of trigger %s", ref, strings.Join(patterns, " or "), buildTrigger.Name)
+}
+
+// checkStep returns the problems preventing step of d from being run with the trigger
+// triggerKey and substitutions.
+func checkStep(d *dag.Dag, step config.Step, triggerKey string, substitutions map[string]string, triggers map[string]*gcp.BuildTrigger) []string {
+	buildTrigger := triggers[triggerKey]
+	if buildTrigger == nil {
+		return []string{"no trigger matching " + triggerKey + " found"}
+	}
+	problems := []string{}
+	if buildTrigger.Disabled {
+		problems = append(problems, "trigger "+triggerKey+" is disabled")
+	}
+	for _, err := range []error{
+		validateSubstitutions(buildTrigger, substitutions),
+		checkRequiredSubstitutions(buildTrigger, substitutions),
+		checkOutputReferences(d, step, substitutions),
+	} {
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	return problems
+}
+
+// checkPermissions returns the projects of the run whose triggers the caller can't run, as
+// problems, and those whose permissions couldn't be checked, as warnings.
+func checkPermissions(ctx *executionContext) (problems []string, warnings []string) {
+	projects := []string{}
+	for _, loc := range listUniqueLocations(ctx.conf, ctx.dag) {
+		if !utils.Contains(projects, loc.projectId) {
+			projects = append(projects, loc.projectId)
+		}
+	}
+	sort.Strings(projects)
+	for _, project := range projects {
+		granted, err := ctx.backend.HasPermission(project, gcp.BuildsCreatePermission)
+		if err != nil {
+			warnings = append(warnings, "\t"+project+": couldn't check the permissions: "+err.Error())
+		} else if !granted {
+			problems = append(problems, "\t"+project+": missing the permission "+gcp.BuildsCreatePermission)
+		}
+	}
+	return problems, warnings
+}
+
+// checkBranch returns a problem when ref, a branch, doesn't exist in the repository of
+// the trigger of step, or a warning when that couldn't be checked. Commit SHAs aren't checked.
+func checkBranch(ctx *executionContext, step config.Step, ref string) (problem string, warning string) {
+	buildTrigger := ctx.triggers[ctx.conf.GetTriggerKey(step)]
+	if buildTrigger == nil || ref == "" {
+		return "", ""
+	}
+	if matched, _ := regexp.MatchString(gitShaRegex, ref); matched {
+		return "", ""
+	}
+	exists, err := ctx.backend.HasBranch(step.ProjectId, buildTrigger, ref)
+	if err != nil {
+		return "", "couldn't check that branch " + ref + " exists in the repository of trigger " + buildTrigger.Name + ": " + err.Error()
+	} else if !exists {
+		return "branch " + ref + " doesn't exist in the repository of trigger " + buildTrigger.Name, ""
+	}
+	return "", ""
+}
+
+// preflight lists the triggers of the run and checks, before any build is triggered, that
+// every step can be run. The error reports every problem found.
+func preflight(ctx *executionContext) error {
+	triggers, err := listTriggers(ctx.conf, ctx.dag, ctx.backend)
+	if err != nil {
+		return err
+	}
+	ctx.triggers = triggers
+
+	problems, warnings := checkPermissions(ctx)
+	ref := getRef(ctx.options.Reference, ctx.exactRef)
+	// The steps sharing a trigger share its repository.
+	checkedBranches := map[string]bool{}
+	for _, step := range ctx.conf.Steps {
+		if step.IsSuccessful() || step.BuildId != "" {
+			continue
+		}
+		triggerKey := ctx.conf.GetTriggerKey(step)
+		substitutions := runSubstitutions(ctx.conf, step, ctx.options.Substitutions, triggers)
+		for _, problem := range checkStep(ctx.dag, step, triggerKey, substitutions, triggers) {
+			problems = append(problems, "\t"+step.Name+": "+problem)
+		}
+		if warning := checkRefFilters(triggers[triggerKey], ref); warning != "" {
+			warnings = append(warnings, "\t"+step.Name+": "+warning)
+		}
+		if checkedBranches[triggerKey] {
+			continue
+		}
+		checkedBranches[triggerKey] = true
+		problem, warning := checkBranch(ctx, step, ref)
+		if problem != "" {
+			problems = append(problems, "\t"+step.Name+": "+problem)
+		}
+		if warning != "" {
+			warnings = append(warnings, "\t"+step.Name+": "+warning)
+		}
+	}
+	if len(warnings) > 0 {
+		fmt.Printf("# %s preflight warnings:\n%s\n", ctx.conf.Name, strings.Join(warnings, "\n"))
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "\n"))
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package flow
+
+import (
+	"cork/config"
+	"cork/gcp"
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/api/cloudbuild/v1"
+)
+
+func TestPreflight(t *testing.T) {
+	tcs := []struct {
+		name        string
+		setup       func(backend *gcp.FakeBackend, ctx *executionContext)
+		expectedErr string
+	}{
+		{
+			name:  "ok",
+			setup: func(backend *gcp.FakeBackend, ctx *executionContext) {},
+		},
+		{
+			name: "listing failure",
+			setup: func(backend *gcp.FakeBackend, ctx *executionContext) {
+				backend.FailListing(testProject, errors.New("permission denied"))
+			},
+			expectedErr: "couldn't list the triggers of:\n\ttest-project (global): permission denied",
+		},
+		{
+			name: "permission check failure",
+			setup: func(backend *gcp.FakeBackend, ctx *executionContext) {
+				backend.FailPermissionCheck(testProject, errors.New("quota exceeded"))
+			},
+		},
+		{
+			name: "missing branch",
+			setup: func(backend *gcp.FakeBackend, ctx *executionContext) {
+				backend.DeleteBranch("develop")
+			},
+			expectedErr: "\ta: branch develop doesn't exist in the repository of trigger a-trigger\n" +
+				"\tb: branch develop doesn't exist in the repository of trigger b-trigger\n" +
+				"\tc: branch develop doesn't exist in the repository of trigger c-trigger",
+		},
+		{
+			name: "required substitutions",
+			setup: func(backend *gcp.FakeBackend, ctx *executionContext) {
+				backend.AddTrigger(testProject, "b-trigger").Build = &cloudbuild.Build{
+					Steps: []*cloudbuild.BuildStep{{Args: []string{"deploy", "${_VERSION}"}}},
+				}
+			},
+			expectedErr: "\tb: the build of trigger b-trigger requires the substitutions _VERSION",
+		},
+		{
+			name: "every problem",
+			setup: func(backend *gcp.FakeBackend, ctx *executionContext) {
+				backend.DenyPermission(testProject, gcp.BuildsCreatePermission)
+				backend.AddTrigger(testProject, "a-trigger").Disabled = true
+				backend.AddTrigger(testProject, "b-trigger").Substitutions["_VERSION"] = ""
+				ctx.conf.Steps[2].Trigger = "missing"
+			},
+			expectedErr: "\ttest-project: missing the permission cloudbuild.builds.create\n" +
+				"\ta: trigger test-project/a-trigger is disabled\n" +
+				"\tc: no trigger matching test-project/missing found",
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			backend := gcp.NewFakeBackend()
+			ctx := buildTestContext(t, []config.Step{testStep("a"), testStep("b", "a"), testStep("c")}, backend)
+			tc.setup(backend, ctx)
+
+			err := preflight(ctx)
+			if tc.expectedErr == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %s", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("expected error %q", tc.expectedErr)
+			}
+			if d := cmp.Diff(tc.expectedErr, err.Error()); d != "" {
+				t.Errorf("unexpected error (-want, +got): %s", d)
+			}
+		})
+	}
+}
+
+func TestCheckRefFilters(t *testing.T) {
+	tcs := []struct {
+		name     string
+		trigger  *gcp.BuildTrigger
+		ref      string
+		expected string
+	}{
+		{
+			name:    "no filter",
+			trigger: &gcp.BuildTrigger{Name: "t"},
+			ref:     "develop",
+		},
+		{
+			name:    "matching branch",
+			trigger: &gcp.BuildTrigger{Name: "t", TriggerTemplate: &cloudbuild.RepoSource{BranchName: "^(develop|main)$"}},
+			ref:     "develop",
+		},
+		{
+			name:     "other branch",
+			trigger:  &gcp.BuildTrigger{Name: "t", TriggerTemplate: &cloudbuild.RepoSource{BranchName: "^main$"}},
+			ref:      "develop",
+			expected: "reference develop doesn't match ^main$ of trigger t",
+		},
+		{
+			name:    "inverted filter",
+			trigger: &gcp.BuildTrigger{Name: "t", TriggerTemplate: &cloudbuild.RepoSource{BranchName: "^main$", InvertRegex: true}},
+			ref:     "develop",
+		},
+		{
+			name: "github tag",
+			trigger: &gcp.BuildTrigger{Name: "t", Github: &cloudbuild.GitHubEventsConfig{
+				Push: &cloudbuild.PushFilter{Tag: "^v.*"},
+			}},
+			ref: "v1.2.0",
+		},
+		{
+			name:    "commit sha",
+			trigger: &gcp.BuildTrigger{Name: "t", TriggerTemplate: &cloudbuild.RepoSource{BranchName: "^main$"}},
+			ref:     "0123456789abcdef",
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			if warning := checkRefFilters(tc.trigger, tc.ref); warning != tc.expected {
+				t.Errorf("got warning %q, want %q", warning, tc.expected)
+			}
+		})
+	}
+}
+
+func TestCheckRequiredSubstitutions(t *testing.T) {
+	build := &cloudbuild.Build{
+		Steps: []*cloudbuild.BuildStep{
+			{Name: "gcr.io/cloud-builders/docker", Args: []string{"build", "-t", "${_IMAGE}:$_TAG", "$$_LITERAL", "$PROJECT_ID"}},
+			{Name: "gcr.io/cloud-builders/gcloud", Env: []string{"ENV=${_ENV}"}},
+		},
+		Images: []string{"${_IMAGE}:$_TAG"},
+	}
+	tcs := []struct {
+		name          string
+		trigger       *gcp.BuildTrigger
+		substitutions map[string]string
+		expected      string
+	}{
+		{
+			name:    "build from a file",
+			trigger: &gcp.BuildTrigger{Name: "t"},
+		},
+		{
+			name:     "missing",
+			trigger:  &gcp.BuildTrigger{Name: "t", Build: build},
+			expected: "the build of trigger t requires the substitutions _ENV, _IMAGE, _TAG",
+		},
+		{
+			name: "declared, defined and given",
+			trigger: &gcp.BuildTrigger{
+				Name:          "t",
+				Substitutions: map[string]string{"_IMAGE": "api"},
+				Build: &cloudbuild.Build{
+					Steps:         build.Steps,
+					Images:        build.Images,
+					Substitutions: map[string]string{"_ENV": "dev"},
+				},
+			},
+			substitutions: map[string]string{"_TAG": "v1"},
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			err := checkRequiredSubstitutions(tc.trigger, tc.substitutions)
+			if tc.expected == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %s", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tc.expected {
+				t.Errorf("got error %v, want %s", err, tc.expected)
+			}
+		})
+	}
+}
@@ -1,107 +1,231 @@
 package flow
 
 import (
+	"context"
 	"cork/cmd"
 	"cork/config"
 	"cork/dag"
 	"cork/gcp"
-	"cork/utils"
 	"errors"
 	"fmt"
+	"sort"
+	"strings"
 	"sync"
+	"time"
+)
+
+const (
+	defaultPollInterval = 5 * time.Second
 )
 
 type executionContext struct {
-	lock     sync.Mutex
-	conf     *config.Config
-	exactRef string
-	options  cmd.Options
-	triggers map[string]*gcp.BuildTrigger
-	dag      *dag.Dag
+	lock         sync.Mutex
+	conf         *config.Config
+	exactRef     string
+	options      cmd.Options
+	triggers     map[string]*gcp.BuildTrigger
+	dag          *dag.Dag
+	backend      gcp.Backend
+	pollInterval time.Duration
+	approve      func(waitInput WaitInput) bool
+	builds       *buildTracker
+	runCtx       context.Context
+	abort        context.CancelFunc
+	state        *RunState
+	// workers bounds the steps handled at once, shared by the runs of the same invocation.
+	workers chan struct{}
+	// external are the dependencies of the steps on steps of other runs, by step, and
+	// dependents the runs having such dependencies on the steps of this one.
+	external   map[string][]externalDependency
+	dependents []*executionContext
+	// changes wakes the run up when steps of the runs it depends on finished.
+	changes chan struct{}
+	// finished is set once the run ended, its steps not started yet never being run.
+	finished bool
+	// interrupted and orchestrationError record why a run stopped early.
+	interrupted        bool
+	orchestrationError bool
+}
+
+var (
+	errAborted  = errors.New("run aborted")
+	errRejected = errors.New("cancelled by user")
+)
+
+func newExecutionContext(parent context.Context, d *dag.Dag, conf *config.Config, options cmd.Options, backend gcp.Backend) *executionContext {
+	runCtx, abort := context.WithCancel(parent)
+	return &executionContext{
+		options:      options,
+		conf:         conf,
+		dag:          d,
+		backend:      backend,
+		pollInterval: defaultPollInterval,
+		approve:      waitForInput,
+		builds:       newBuildTracker(),
+		workers:      make(chan struct{}, options.NumParallelJobs),
+		external:     map[string][]externalDependency{},
+		changes:      make(chan struct{}, 1),
+		runCtx:       runCtx,
+		abort:        abort,
+	}
+}
+
+// location is a region of a project where triggers are listed.
+type location struct {
+	projectId string
+	region    string
 }
 
-func listUniqueProjects(d *dag.Dag) []string {
-	uniqueProjectIDs := []string{}
+func listUniqueLocations(conf *config.Config, d *dag.Dag) []location {
+	uniqueLocations := []location{}
+	seen := map[location]bool{}
 	for _, node := range d.Nodes {
-		projectID := node.Task.(config.Step).ProjectId
-		if !utils.Contains(uniqueProjectIDs, projectID) {
-			uniqueProjectIDs = append(uniqueProjectIDs, projectID)
+		step := node.Task.(config.Step)
+		loc := location{projectId: step.ProjectId, region: conf.GetRegion(step)}
+		if !seen[loc] {
+			seen[loc] = true
+			uniqueLocations = append(uniqueLocations, loc)
 		}
 	}
-	return uniqueProjectIDs
+	return uniqueLocations
 }
 
-func listTriggers(d *dag.Dag) map[string]*gcp.BuildTrigger {
+// listTriggers returns the triggers of every project and region used by the steps, by gcp.TriggerKey,
+// or an error listing every location whose triggers couldn't be listed.
+func listTriggers(conf *config.Config, d *dag.Dag, backend gcp.Backend) (map[string]*gcp.BuildTrigger, error) {
 	triggers := map[string]*gcp.BuildTrigger{}
-	uniqueProjects := listUniqueProjects(d)
-	for _, project := range uniqueProjects {
-		for k, v := range gcp.ListTriggers(project) {
+	failures := []string{}
+	for _, loc := range listUniqueLocations(conf, d) {
+		locationTriggers, err := backend.ListTriggers(loc.projectId, loc.region)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("\t%s (%s): %s", loc.projectId, loc.region, err))
+			continue
+		}
+		for k, v := range locationTriggers {
 			triggers[k] = v
 		}
 	}
-	return triggers
+	if len(failures) > 0 {
+		sort.Strings(failures)
+		return nil, errors.New("couldn't list the triggers of:\n" + strings.Join(failures, "\n"))
+	}
+	return triggers, nil
 }
 
 func waitForDepBuilds(ctx *executionContext, step config.Step, triggerName string) error {
 	if step.Manual {
 		for _, dep := range step.DependsOn {
-			if ctx.dag.Nodes[dep].Task.(config.Step).Status != gcp.SUCCESS {
-				message := step.Name + " depends on " + dep + " that has status " + ctx.dag.Nodes[dep].Task.(config.Step).Status
+			depStep := getDependency(ctx, step.Name, dep)
+			if depStep.Status != gcp.SUCCESS {
+				message := step.Name + " depends on " + dep + " that has status " + depStep.Status
 				flowLog(Log{Message: message, Progress: SKIP})
-				return nil
+				return errors.New(message)
 			}
-			ynResponse := waitForInput(WaitInput{
+			ynResponse := ctx.approve(WaitInput{
 				Trigger: triggerName,
 				Message: fmt.Sprintf("Please validate %s to continue", dep),
-				LogUrl:  ctx.dag.Nodes[dep].Task.(config.Step).LogUrl,
+				LogUrl:  depStep.LogUrl,
 			})
 
 			if !ynResponse {
 				message := triggerName + " cancelled by user"
 				flowLog(Log{Message: message, Progress: SKIP})
-				return errors.New(message)
+				return errRejected
 			}
 		}
 	}
 	return nil
 }
 
-func handleTrigger(node *dag.Node, ctx *executionContext) error {
-	step := node.Task.(config.Step)
-	defer func() {
-		node.Task = step
-	}()
-	triggerFullName := step.ProjectId + "/" + step.Trigger
+// logTriggerName returns the name the logs of step are prefixed with: the config and the
+// trigger, or the step when other steps of the config, such as the expansions of a matrix,
+// run a trigger of the same name.
+func logTriggerName(conf *config.Config, step config.Step) string {
+	for _, other := range conf.Steps {
+		if other.Name != step.Name && other.Trigger == step.Trigger {
+			return conf.Name + "/" + step.Name
+		}
+	}
+	return conf.Name + "/" + step.Trigger
+}
+
+func getStep(ctx *executionContext, key string) config.Step {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	return ctx.dag.Nodes[key].Task.(config.Step)
+}
+
+// setStep publishes the step in the dag and saves the run state.
+func setStep(ctx *executionContext, step config.Step) {
 	func() {
 		ctx.lock.Lock()
 		defer ctx.lock.Unlock()
-		step.Status = SKIP
+		ctx.dag.Nodes[step.Name].Task = step
 	}()
+	saveState(ctx)
+}
+
+// triggerBuild runs the trigger of the step once its manual validation, if any, was given.
+func triggerBuild(ctx *executionContext, step *config.Step, triggerName string) (*gcp.BuildOperation, error) {
+	triggerFullName := ctx.conf.GetTriggerKey(*step)
 	buildTrigger := ctx.triggers[triggerFullName]
-	ref := getRef(ctx.options.Reference, ctx.exactRef)
 	if buildTrigger == nil {
+		step.Status = config.ERROR
 		message := ctx.conf.Name + " no trigger matching " + triggerFullName + " found"
 		flowLog(Log{Message: message, Progress: SKIP})
-		return errors.New(message)
+		return nil, errors.New(message)
+	}
+	substitutions, err := stepSubstitutions(ctx, *step)
+	if err == nil {
+		err = validateSubstitutions(buildTrigger, substitutions)
 	}
-	triggerName := ctx.conf.Name + "/" + buildTrigger.Name
-	err := waitForDepBuilds(ctx, step, triggerName)
 	if err != nil {
-		return err
+		step.Status = config.ERROR
+		flowLog(Log{Message: ctx.conf.Name + " " + err.Error(), Progress: SKIP})
+		return nil, err
+	}
+	err = waitForDepBuilds(ctx, *step, triggerName)
+	if err == errRejected {
+		step.Status = config.REJECTED
+		return nil, err
+	} else if err != nil {
+		step.Status = config.SKIPPED
+		return nil, err
+	}
+	if ctx.runCtx.Err() != nil {
+		step.Status = config.SKIPPED
+		return nil, errAborted
 	}
 	flowLog(Log{Trigger: triggerName, Message: "started", Progress: gcp.RUNNING})
-	build, err := gcp.TriggerCloudBuild(
-		step.ProjectId,
-		buildTrigger.Id,
-		getSourceRepo(ref),
-	)
+	return runTrigger(ctx, step, triggerName)
+}
+
+// runTrigger starts a build of the step, on the pinned commit once there is one.
+func runTrigger(ctx *executionContext, step *config.Step, triggerName string) (*gcp.BuildOperation, error) {
+	buildTrigger := ctx.triggers[ctx.conf.GetTriggerKey(*step)]
+	ctx.lock.Lock()
+	ref := getRef(ctx.options.Reference, ctx.exactRef)
+	ctx.lock.Unlock()
+	source := getSourceRepo(ref)
+	substitutions, err := stepSubstitutions(ctx, *step)
+	var build *gcp.BuildOperation
+	if err == nil {
+		source.Substitutions = substitutions
+		build, err = ctx.backend.RunTrigger(
+			step.ProjectId,
+			ctx.conf.GetRegion(*step),
+			buildTrigger.Id,
+			source,
+		)
+	}
 	if err != nil {
+		step.Status = config.ERROR
 		flowLog(Log{
 			Trigger:  triggerName,
 			Message:  err.Error(),
 			Progress: gcp.FAILURE,
 		})
-		return err
+		return nil, err
 	}
 
 	func() {
@@ -109,34 +233,146 @@ func handleTrigger(node *dag.Node, ctx *executionContext) error {
 		defer ctx.lock.Unlock()
 		setExactRef(&ctx.exactRef, build)
 	}()
+	step.Attempts++
+	step.BuildId = build.ID
+	step.CommitSha = build.CommitSha
+	step.LogUrl = build.LogURL
+	setStep(ctx, *step)
+	return build, nil
+}
+
+// followBuild waits for the build to reach a final status, cancelling it if the run is aborted.
+func followBuild(ctx *executionContext, step *config.Step, build *gcp.BuildOperation, triggerName string) (string, error) {
+	tracked := trackedBuild{
+		Step:      step.Name,
+		ProjectId: step.ProjectId,
+		Region:    ctx.conf.GetRegion(*step),
+		BuildId:   build.ID,
+		Trigger:   triggerName,
+		LogUrl:    build.LogURL,
+	}
+	if !ctx.builds.add(tracked) {
+		cancelBuild(ctx, tracked)
+		step.Status = config.ABORTED
+		return "", errAborted
+	}
 
-	flowLog(Log{
-		Trigger:  triggerName,
-		Message:  "triggered",
-		LogUrl:   build.LogURL,
-		Progress: gcp.RUNNING,
-	})
+	status, err := waitForBuild(ctx, step, tracked)
+	if status == gcp.CANCELLED && ctx.runCtx.Err() != nil {
+		// The build was cancelled by cork itself, aborting the run.
+		err = errAborted
+	}
+	if err == errAborted {
+		step.Status = config.ABORTED
+		return "", err
+	} else if err != nil {
+		step.Status = config.ERROR
+		return "", err
+	}
+	ctx.builds.remove(build.ID)
+	step.Status = status
+	return status, nil
+}
+
+// waitForRetry sleeps for the backoff of the step unless the run is aborted meanwhile.
+func waitForRetry(ctx *executionContext, step config.Step) error {
+	timer := time.NewTimer(step.Retry.Delay(step.Attempts))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.runCtx.Done():
+		return errAborted
+	}
+}
 
-	status, err := waitForBuild(step.ProjectId, build.ID)
+func handleTrigger(key string, ctx *executionContext) error {
+	step := getStep(ctx, key)
+	defer func() {
+		setStep(ctx, step)
+	}()
+	triggerName := logTriggerName(ctx.conf, step)
+	var startTime time.Time
+	defer func() {
+		if !startTime.IsZero() {
+			step.Duration += time.Since(startTime)
+		}
+	}()
+
+	var build *gcp.BuildOperation
+	if step.BuildId != "" {
+		// The build was started by the run being resumed.
+		startTime = time.Now()
+		build = &gcp.BuildOperation{
+			ID:        step.BuildId,
+			LogURL:    step.LogUrl,
+			CommitSha: step.CommitSha,
+		}
+		flowLog(Log{
+			Trigger:  triggerName,
+			Message:  "reattached",
+			LogUrl:   build.LogURL,
+			Progress: gcp.RUNNING,
+		})
+	} else {
+		var err error
+		build, err = triggerBuild(ctx, &step, triggerName)
+		if err != nil {
+			return err
+		}
+		startTime = time.Now()
+		flowLog(Log{
+			Trigger:  triggerName,
+			Message:  "triggered",
+			LogUrl:   build.LogURL,
+			Progress: gcp.RUNNING,
+		})
+	}
+
+	status, err := followBuild(ctx, &step, build, triggerName)
 	if err != nil {
 		return err
 	}
-	func() {
-		ctx.lock.Lock()
-		defer ctx.lock.Unlock()
-		step.Status = status
-		step.LogUrl = build.LogURL
-	}()
+	for step.Retry.ShouldRetry(step.Attempts, status) {
+		flowLog(Log{
+			Trigger: triggerName,
+			Message: fmt.Sprintf("%s, retrying in %s (attempt %d/%d)",
+				status, step.Retry.Delay(step.Attempts), step.Attempts+1, step.Retry.MaxAttempts),
+			LogUrl:   build.LogURL,
+			Progress: status,
+		})
+		step.Status = gcp.RUNNING
+		setStep(ctx, step)
+		if err := waitForRetry(ctx, step); err != nil {
+			step.Status = config.ABORTED
+			return err
+		}
+		build, err = runTrigger(ctx, &step, triggerName)
+		if err != nil {
+			return err
+		}
+		flowLog(Log{
+			Trigger:  triggerName,
+			Message:  fmt.Sprintf("triggered (attempt %d/%d)", step.Attempts, step.Retry.MaxAttempts),
+			LogUrl:   build.LogURL,
+			Progress: gcp.RUNNING,
+		})
+		status, err = followBuild(ctx, &step, build, triggerName)
+		if err != nil {
+			return err
+		}
+	}
 
 	switch status {
 	case gcp.SUCCESS:
+		collectOutputs(ctx, &step, build.ID, triggerName)
 		flowLog(Log{
 			Trigger:  triggerName,
 			Message:  "finished",
 			LogUrl:   build.LogURL,
 			Progress: status,
 		})
-	case gcp.FAILURE, gcp.CANCELLED:
+	default:
 		flowLog(Log{
 			Trigger:  triggerName,
 			Message:  status,
@@ -144,79 +380,217 @@ func handleTrigger(node *dag.Node, ctx *executionContext) error {
 			Progress: status,
 		})
 		return errors.New("build failed")
-	default:
-		return errors.New("Unknown status " + status)
 	}
 	return nil
 }
 
-func runJob(jobs chan *dag.Node, results chan error, ctx *executionContext) {
-	for j := range jobs {
-		err := handleTrigger(j, ctx)
-		results <- err
+type jobResult struct {
+	key string
+	err error
+}
+
+func runJob(jobs chan string, results chan jobResult, ctx *executionContext) {
+	for key := range jobs {
+		ctx.workers <- struct{}{}
+		err := handleTrigger(key, ctx)
+		<-ctx.workers
+		results <- jobResult{key: key, err: err}
 	}
 }
 
-func initJobs(jobs chan *dag.Node, results chan error, ctx *executionContext) {
+func initJobs(jobs chan string, results chan jobResult, ctx *executionContext) {
 	for w := 0; w < ctx.options.NumParallelJobs; w++ {
 		go runJob(jobs, results, ctx)
 	}
 }
 
-func startStep(jobs chan *dag.Node, node *dag.Node) {
-	step := node.Task.(config.Step)
-	step.Status = gcp.RUNNING
-	node.Task = step
-	jobs <- node
+// scheduleSteps starts every step whose dependencies succeeded, in the run and in other
+// runs, and returns how many were started. The steps depending on a step of another run
+// that didn't succeed are skipped along with their descendants.
+func scheduleSteps(ctx *executionContext, jobs chan string) (int, error) {
+	readiness, failures := externalReadiness(ctx)
+	blocked := []string{}
+	started, err := func() (int, error) {
+		ctx.lock.Lock()
+		defer ctx.lock.Unlock()
+		schedulableStepKeys, err := ctx.dag.GetNodesToSchedule()
+		if err != nil {
+			return 0, err
+		}
+		started := 0
+		for _, stepKey := range schedulableStepKeys {
+			node := ctx.dag.Nodes[stepKey]
+			step := node.Task.(config.Step)
+			switch readiness[stepKey] {
+			case externalWaiting:
+				continue
+			case externalFailed:
+				step.Status = config.SKIPPED
+				node.Task = step
+				flowLog(Log{Message: ctx.conf.Name + "/" + step.Name + " skipped because " + failures[stepKey] + " didn't succeed", Progress: SKIP})
+				blocked = append(blocked, stepKey)
+				continue
+			}
+			step.Status = gcp.RUNNING
+			node.Task = step
+			jobs <- stepKey
+			started++
+		}
+		return started, nil
+	}()
+	for _, stepKey := range blocked {
+		skipDescendants(ctx, stepKey)
+	}
+	if len(blocked) > 0 {
+		notifyDependents(ctx)
+	}
+	return started, err
+}
+
+// skipDescendants marks every step depending on key as SKIPPED so that independent
+// branches can go on while the run still terminates.
+func skipDescendants(ctx *executionContext, key string) {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	for _, descendant := range ctx.dag.GetDescendants(key) {
+		node := ctx.dag.Nodes[descendant]
+		step := node.Task.(config.Step)
+		if step.HasStarted() {
+			continue
+		}
+		step.Status = config.SKIPPED
+		node.Task = step
+		flowLog(Log{Message: ctx.conf.Name + "/" + step.Name + " skipped because " + key + " didn't succeed", Progress: SKIP})
+	}
 }
 
-func waitForResults(options cmd.Options, jobsNumber int, d *dag.Dag, jobs chan *dag.Node, results chan error) {
-	for i := 0; i < jobsNumber; i++ {
-		result := <-results
-		if result != nil && !options.NoFastFailing {
-			fmt.Println(result.Error())
-			fmt.Println("Fast failing")
+// waitForResults schedules the steps as their dependencies finish, until every step
+// started finished and no step waits for steps of other runs anymore.
+func waitForResults(ctx *executionContext, pending int, jobs chan string, results chan jobResult) {
+	for pending > 0 || waitingOnExternal(ctx) {
+		select {
+		case result := <-results:
+			pending--
+			if result.err != nil {
+				if !ctx.options.NoFastFailing {
+					fmt.Println(result.err.Error())
+					fmt.Println("Fast failing")
+					cancelBuilds(ctx)
+					abortSteps(ctx)
+					return
+				}
+				skipDescendants(ctx, result.key)
+			}
+			notifyDependents(ctx)
+		case <-ctx.changes:
+		case <-ctx.runCtx.Done():
+			fmt.Printf("# %s interrupted\n", ctx.conf.Name)
+			setRunError(ctx, &ctx.interrupted)
+			cancelBuilds(ctx)
+			abortSteps(ctx)
 			return
 		}
 
-		schedulableStepKeys, err := d.GetNodesToSchedule()
+		started, err := scheduleSteps(ctx, jobs)
 		if err != nil {
 			fmt.Println(err.Error())
+			setRunError(ctx, &ctx.orchestrationError)
+			cancelBuilds(ctx)
+			abortSteps(ctx)
 			return
 		}
+		pending += started
+	}
+}
 
-		for _, stepKey := range schedulableStepKeys {
-			startStep(jobs, d.Nodes[stepKey])
+// abortSteps marks the steps of the aborted run that didn't finish: ABORTED for those
+// whose build was cancelled, SKIPPED for those scheduled but never triggered.
+func abortSteps(ctx *executionContext) {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	for _, node := range ctx.dag.Nodes {
+		step := node.Task.(config.Step)
+		if !step.HasStarted() || step.HasFinished() {
+			continue
+		}
+		step.Status = config.SKIPPED
+		if step.BuildId != "" {
+			step.Status = config.ABORTED
+		}
+		node.Task = step
+	}
+}
+
+// countSteps returns the number of succeeded, failed and skipped steps, steps never
+// started or aborted counting as skipped.
+func countSteps(ctx *executionContext) (succeeded int, failed int, skipped int) {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	for _, node := range ctx.dag.Nodes {
+		step := node.Task.(config.Step)
+		switch {
+		case step.IsSuccessful():
+			succeeded++
+		case step.Status == config.SKIPPED || step.Status == config.ABORTED || !step.HasStarted():
+			skipped++
+		default:
+			failed++
 		}
 	}
+	return
 }
 
-func run(d *dag.Dag, conf *config.Config, options cmd.Options) {
-	triggers := listTriggers(d)
+// reattachSteps follows again the builds started by the run being resumed and
+// returns how many were reattached.
+func reattachSteps(ctx *executionContext, jobs chan string) int {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	reattached := 0
+	for key, node := range ctx.dag.Nodes {
+		step := node.Task.(config.Step)
+		if step.HasStarted() && !step.HasFinished() && step.BuildId != "" {
+			jobs <- key
+			reattached++
+		}
+	}
+	return reattached
+}
 
-	jobs := make(chan *dag.Node, len(d.Nodes))
-	defer close(jobs)
+func setRunError(ctx *executionContext, flag *bool) {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	*flag = true
+}
 
-	results := make(chan error, len(d.Nodes))
-	defer close(results)
+// run executes the steps of the dag, once preflight passed, and returns the exit code matching the outcome.
+// The summary of the run is printed by the caller.
+func run(ctx *executionContext) int {
+	defer ctx.abort()
+	// The runs depending on steps of this one stop waiting for them once it ended.
+	defer func() {
+		setRunError(ctx, &ctx.finished)
+		notifyDependents(ctx)
+	}()
+	d := ctx.dag
 
-	ctx := &executionContext{
-		options:  options,
-		conf:     conf,
-		triggers: triggers,
-		dag:      d,
-	}
+	jobs := make(chan string, len(d.Nodes))
+	defer close(jobs)
+
+	// results is never closed: workers still running after an abort may send to it.
+	results := make(chan jobResult, len(d.Nodes))
 
 	initJobs(jobs, results, ctx)
 
-	schedulableStepKeys, err := d.GetNodesToSchedule()
+	reattached := reattachSteps(ctx, jobs)
+	started, err := scheduleSteps(ctx, jobs)
 	if err != nil {
 		fmt.Println(err)
-		return
-	}
-	for _, stepKey := range schedulableStepKeys {
-		startStep(jobs, d.Nodes[stepKey])
+		return ExitOrchestrationError
 	}
+	saveState(ctx)
+
+	waitForResults(ctx, reattached+started, jobs, results)
 
-	waitForResults(options, len(d.Nodes), d, jobs, results)
+	saveState(ctx)
+	return exitCode(ctx)
 }
@@ -0,0 +1,751 @@
+package flow
+
+import (
+	"context"
+	"cork/cmd"
+	"cork/config"
+	"cork/dag"
+	"cork/gcp"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+const (
+	testProject = "test-project"
+)
+
+func buildTestContext(t *testing.T, steps []config.Step, backend *gcp.FakeBackend) *executionContext {
+	t.Helper()
+	conf := &config.Config{Name: "test", Steps: steps}
+	d, err := dag.BuildDag(config.Steps(conf.Steps), conf.GetLinks())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, step := range steps {
+		if step.Trigger != "" {
+			backend.AddRegionalTrigger(step.ProjectId, conf.GetRegion(step), step.Trigger)
+		}
+	}
+	ctx := newExecutionContext(context.Background(), d, conf, cmd.Options{Reference: "develop", NumParallelJobs: 2}, backend)
+	ctx.pollInterval = time.Millisecond
+	ctx.approve = func(waitInput WaitInput) bool {
+		t.Fatalf("unexpected manual approval for %s", waitInput.Trigger)
+		return false
+	}
+	ctx.triggers, err = listTriggers(conf, d, backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ctx
+}
+
+func testStep(name string, dependsOn ...string) config.Step {
+	return config.Step{
+		Name:      name,
+		ProjectId: testProject,
+		Trigger:   name + "-trigger",
+		DependsOn: dependsOn,
+	}
+}
+
+func stepStatus(ctx *executionContext, name string) string {
+	return ctx.dag.Nodes[name].Task.(config.Step).Status
+}
+
+func TestHandleTrigger(t *testing.T) {
+	tcs := []struct {
+		name           string
+		outcomes       []gcp.FakeOutcome
+		expectedErr    bool
+		expectedStatus string
+	}{
+		{
+			name:           "success",
+			expectedStatus: gcp.SUCCESS,
+		},
+		{
+			name:           "failure",
+			outcomes:       []gcp.FakeOutcome{{Status: gcp.FAILURE}},
+			expectedErr:    true,
+			expectedStatus: gcp.FAILURE,
+		},
+		{
+			name:           "cancelled",
+			outcomes:       []gcp.FakeOutcome{{Status: gcp.CANCELLED, Duration: 5 * time.Millisecond}},
+			expectedErr:    true,
+			expectedStatus: gcp.CANCELLED,
+		},
+		{
+			name:           "queued then working",
+			outcomes:       []gcp.FakeOutcome{{Duration: 10 * time.Millisecond, QueuedDuration: 5 * time.Millisecond}},
+			expectedStatus: gcp.SUCCESS,
+		},
+		{
+			name:           "timeout",
+			outcomes:       []gcp.FakeOutcome{{Status: gcp.TIMEOUT}},
+			expectedErr:    true,
+			expectedStatus: gcp.TIMEOUT,
+		},
+		{
+			name:           "internal error",
+			outcomes:       []gcp.FakeOutcome{{Status: gcp.INTERNAL_ERROR}},
+			expectedErr:    true,
+			expectedStatus: gcp.INTERNAL_ERROR,
+		},
+		{
+			name:           "expired",
+			outcomes:       []gcp.FakeOutcome{{Status: gcp.EXPIRED, QueuedDuration: 5 * time.Millisecond, Duration: 5 * time.Millisecond}},
+			expectedErr:    true,
+			expectedStatus: gcp.EXPIRED,
+		},
+		{
+			name:           "run error",
+			outcomes:       []gcp.FakeOutcome{{Err: errors.New("quota exceeded")}},
+			expectedErr:    true,
+			expectedStatus: config.ERROR,
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			backend := gcp.NewFakeBackend()
+			ctx := buildTestContext(t, []config.Step{testStep("a")}, backend)
+			backend.SetOutcomes(testProject, "a-trigger", tc.outcomes...)
+
+			err := handleTrigger("a", ctx)
+			if (err != nil) != tc.expectedErr {
+				t.Errorf("got error %v, expected error: %v", err, tc.expectedErr)
+			}
+			if status := stepStatus(ctx, "a"); status != tc.expectedStatus {
+				t.Errorf("got status %s, want %s", status, tc.expectedStatus)
+			}
+		})
+	}
+}
+
+func TestHandleTriggerPinsCommitSha(t *testing.T) {
+	backend := gcp.NewFakeBackend()
+	ctx := buildTestContext(t, []config.Step{testStep("a")}, backend)
+
+	if err := handleTrigger("a", ctx); err != nil {
+		t.Fatal(err)
+	}
+	if ctx.exactRef != backend.CommitSha {
+		t.Errorf("got exact ref %s, want %s", ctx.exactRef, backend.CommitSha)
+	}
+	if logUrl := ctx.dag.Nodes["a"].Task.(config.Step).LogUrl; logUrl == "" {
+		t.Errorf("expected the log url to be set")
+	}
+}
+
+func TestHandleTriggerMissingTrigger(t *testing.T) {
+	backend := gcp.NewFakeBackend()
+	ctx := buildTestContext(t, []config.Step{testStep("a")}, backend)
+	ctx.triggers = map[string]*gcp.BuildTrigger{}
+
+	if err := handleTrigger("a", ctx); err == nil {
+		t.Errorf("expected an error for a missing trigger")
+	}
+	if runs := backend.Runs(); len(runs) != 0 {
+		t.Errorf("expected no build to be triggered, got %v", runs)
+	}
+}
+
+func TestHandleTriggerSubstitutions(t *testing.T) {
+	tcs := []struct {
+		name                  string
+		declared              map[string]string
+		expectedErr           bool
+		expectedSubstitutions map[string]string
+	}{
+		{
+			name:                  "declared",
+			declared:              map[string]string{"_ENV": "", "_TAG": "", "_IMAGE": ""},
+			expectedSubstitutions: map[string]string{"_ENV": "prod", "_TAG": "v2", "_IMAGE": "api"},
+		},
+		{
+			name:                  "defaults and overrides left out",
+			declared:              map[string]string{"_ENV": "", "_TAG": ""},
+			expectedSubstitutions: map[string]string{"_ENV": "prod", "_TAG": "v2"},
+		},
+		{
+			name:        "undeclared",
+			declared:    map[string]string{"_ENV": ""},
+			expectedErr: true,
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			backend := gcp.NewFakeBackend()
+			step := testStep("a")
+			step.Substitutions = map[string]string{"_ENV": "prod", "_TAG": "v1"}
+			ctx := buildTestContext(t, []config.Step{step}, backend)
+			ctx.conf.Substitutions = map[string]string{"_ENV": "dev", "_IMAGE": "api"}
+			ctx.options.Substitutions = map[string]string{"_TAG": "v2"}
+			ctx.triggers[testProject+"/a-trigger"].Substitutions = tc.declared
+
+			err := handleTrigger("a", ctx)
+			if (err != nil) != tc.expectedErr {
+				t.Fatalf("got error %v, expected error: %v", err, tc.expectedErr)
+			}
+			if tc.expectedErr {
+				if status := stepStatus(ctx, "a"); status != config.ERROR {
+					t.Errorf("got status %s, want %s", status, config.ERROR)
+				}
+				if runs := backend.Runs(); len(runs) != 0 {
+					t.Errorf("expected no build to be triggered, got %v", runs)
+				}
+				return
+			}
+			if diff := cmp.Diff(tc.expectedSubstitutions, backend.Sources()[0].Substitutions); diff != "" {
+				t.Errorf("unexpected substitutions (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestHandleTriggerManualApproval(t *testing.T) {
+	tcs := []struct {
+		name         string
+		approved     bool
+		expectedErr  bool
+		expectedRuns []string
+	}{
+		{
+			name:         "approved",
+			approved:     true,
+			expectedRuns: []string{testProject + "/b-trigger"},
+		},
+		{
+			name:         "rejected",
+			approved:     false,
+			expectedErr:  true,
+			expectedRuns: []string{},
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			manual := testStep("b", "a")
+			manual.Manual = true
+			backend := gcp.NewFakeBackend()
+			ctx := buildTestContext(t, []config.Step{testStep("a"), manual}, backend)
+			a := ctx.dag.Nodes["a"].Task.(config.Step)
+			a.Status = gcp.SUCCESS
+			ctx.dag.Nodes["a"].Task = a
+
+			prompts := []string{}
+			ctx.approve = func(waitInput WaitInput) bool {
+				prompts = append(prompts, waitInput.Message)
+				return tc.approved
+			}
+
+			err := handleTrigger("b", ctx)
+			if (err != nil) != tc.expectedErr {
+				t.Errorf("got error %v, expected error: %v", err, tc.expectedErr)
+			}
+			if d := cmp.Diff([]string{"Please validate a to continue"}, prompts); d != "" {
+				t.Errorf("unexpected prompts (-want, +got): %s", d)
+			}
+			if d := cmp.Diff(tc.expectedRuns, backend.Runs()); d != "" {
+				t.Errorf("unexpected runs (-want, +got): %s", d)
+			}
+		})
+	}
+}
+
+func TestRun(t *testing.T) {
+	backend := gcp.NewFakeBackend()
+	ctx := buildTestContext(t, []config.Step{
+		testStep("a"),
+		testStep("b", "a"),
+		testStep("c", "b"),
+	}, backend)
+	backend.SetOutcomes(testProject, "a-trigger", gcp.FakeOutcome{Duration: 5 * time.Millisecond})
+
+	if code := run(ctx); code != ExitSuccess {
+		t.Errorf("got exit code %d, want %d", code, ExitSuccess)
+	}
+
+	expectedRuns := []string{testProject + "/a-trigger", testProject + "/b-trigger", testProject + "/c-trigger"}
+	if d := cmp.Diff(expectedRuns, backend.Runs()); d != "" {
+		t.Errorf("unexpected runs (-want, +got): %s", d)
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		if status := stepStatus(ctx, name); status != gcp.SUCCESS {
+			t.Errorf("got status %s for %s, want %s", status, name, gcp.SUCCESS)
+		}
+	}
+}
+
+func TestRunPropagatesOutputs(t *testing.T) {
+	backend := gcp.NewFakeBackend()
+	deploy := testStep("deploy", "build")
+	deploy.Substitutions = map[string]string{
+		"_DIGEST": "${steps.build.outputs.image_digest}",
+		"_COMMIT": "${steps.build.outputs.commit_sha}",
+	}
+	ctx := buildTestContext(t, []config.Step{testStep("build"), deploy}, backend)
+	ctx.triggers[testProject+"/deploy-trigger"].Substitutions = map[string]string{"_DIGEST": "", "_COMMIT": ""}
+	backend.SetOutcomes(testProject, "build-trigger", gcp.FakeOutcome{Outputs: map[string]string{"image_digest": "sha256:abc"}})
+
+	if code := run(ctx); code != ExitSuccess {
+		t.Fatalf("got exit code %d, want %d", code, ExitSuccess)
+	}
+	expected := map[string]string{"_DIGEST": "sha256:abc", "_COMMIT": backend.CommitSha}
+	if d := cmp.Diff(expected, backend.Sources()[1].Substitutions); d != "" {
+		t.Errorf("unexpected substitutions (-want, +got): %s", d)
+	}
+}
+
+func TestRunRegionalTriggers(t *testing.T) {
+	backend := gcp.NewFakeBackend()
+	global := config.Step{Name: "global", ProjectId: testProject, Trigger: "deploy"}
+	regional := config.Step{Name: "regional", ProjectId: testProject, Trigger: "deploy", Region: "europe-west1", DependsOn: []string{"global"}}
+	ctx := buildTestContext(t, []config.Step{global, regional}, backend)
+
+	if code := run(ctx); code != ExitSuccess {
+		t.Fatalf("got exit code %d, want %d", code, ExitSuccess)
+	}
+	expectedRuns := []string{testProject + "/deploy", testProject + "/europe-west1/deploy"}
+	if d := cmp.Diff(expectedRuns, backend.Runs()); d != "" {
+		t.Errorf("unexpected runs (-want, +got): %s", d)
+	}
+}
+
+func TestRunsShareWorkers(t *testing.T) {
+	backend := gcp.NewFakeBackend()
+	first := buildTestContext(t, []config.Step{testStep("a")}, backend)
+	second := buildTestContext(t, []config.Step{testStep("b")}, backend)
+	backend.SetOutcomes(testProject, "a-trigger", gcp.FakeOutcome{Duration: 30 * time.Millisecond})
+	backend.SetOutcomes(testProject, "b-trigger", gcp.FakeOutcome{Duration: 30 * time.Millisecond})
+	workers := make(chan struct{}, 1)
+	first.workers = workers
+	second.workers = workers
+
+	start := time.Now()
+	done := make(chan int)
+	go func() { done <- run(first) }()
+	go func() { done <- run(second) }()
+	for i := 0; i < 2; i++ {
+		if code := <-done; code != ExitSuccess {
+			t.Errorf("got exit code %d, want %d", code, ExitSuccess)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 60*time.Millisecond {
+		t.Errorf("expected the builds to run one after the other with a single worker, took %s", elapsed)
+	}
+}
+
+func TestWaitForResultsFastFailing(t *testing.T) {
+	backend := gcp.NewFakeBackend()
+	ctx := buildTestContext(t, []config.Step{
+		testStep("a"),
+		testStep("b", "a"),
+	}, backend)
+	backend.SetOutcomes(testProject, "a-trigger", gcp.FakeOutcome{Status: gcp.FAILURE})
+
+	if code := run(ctx); code != ExitBuildFailure {
+		t.Errorf("got exit code %d, want %d", code, ExitBuildFailure)
+	}
+
+	if d := cmp.Diff([]string{testProject + "/a-trigger"}, backend.Runs()); d != "" {
+		t.Errorf("unexpected runs (-want, +got): %s", d)
+	}
+	if status := stepStatus(ctx, "b"); status != "" {
+		t.Errorf("expected b not to be started, got status %s", status)
+	}
+}
+
+func TestFastFailingCancelsBuilds(t *testing.T) {
+	backend := gcp.NewFakeBackend()
+	ctx := buildTestContext(t, []config.Step{
+		testStep("a"),
+		testStep("b"),
+	}, backend)
+	backend.SetOutcomes(testProject, "a-trigger", gcp.FakeOutcome{Status: gcp.FAILURE, Duration: 20 * time.Millisecond})
+	backend.SetOutcomes(testProject, "b-trigger", gcp.FakeOutcome{Duration: time.Minute})
+
+	run(ctx)
+
+	if cancelled := backend.Cancelled(); len(cancelled) != 1 {
+		t.Errorf("expected the build of b to be cancelled, got %v", cancelled)
+	}
+}
+
+func TestInterruptCancelsBuilds(t *testing.T) {
+	backend := gcp.NewFakeBackend()
+	parent, interrupt := context.WithCancel(context.Background())
+	ctx := buildTestContext(t, []config.Step{
+		testStep("a"),
+		testStep("b", "a"),
+	}, backend)
+	ctx.runCtx, ctx.abort = context.WithCancel(parent)
+	backend.SetOutcomes(testProject, "a-trigger", gcp.FakeOutcome{Duration: time.Minute})
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		interrupt()
+	}()
+	if code := run(ctx); code != ExitInterrupted {
+		t.Errorf("got exit code %d, want %d", code, ExitInterrupted)
+	}
+
+	if cancelled := backend.Cancelled(); len(cancelled) != 1 {
+		t.Errorf("expected the build of a to be cancelled, got %v", cancelled)
+	}
+	if d := cmp.Diff([]string{testProject + "/a-trigger"}, backend.Runs()); d != "" {
+		t.Errorf("unexpected runs (-want, +got): %s", d)
+	}
+}
+
+func TestRunNoFastFailingSkipsDescendants(t *testing.T) {
+	manual := testStep("e", "c")
+	manual.Manual = true
+	backend := gcp.NewFakeBackend()
+	ctx := buildTestContext(t, []config.Step{
+		testStep("a"),
+		testStep("b", "a"),
+		testStep("c"),
+		testStep("d", "b", "c"),
+		manual,
+		testStep("f", "e"),
+		testStep("g", "c"),
+	}, backend)
+	ctx.options.NoFastFailing = true
+	ctx.approve = func(waitInput WaitInput) bool {
+		return false
+	}
+	backend.SetOutcomes(testProject, "a-trigger", gcp.FakeOutcome{Status: gcp.FAILURE})
+	backend.SetOutcomes(testProject, "c-trigger", gcp.FakeOutcome{Duration: 20 * time.Millisecond})
+
+	if code := run(ctx); code != ExitBuildFailure {
+		t.Errorf("got exit code %d, want %d", code, ExitBuildFailure)
+	}
+
+	expectedStatuses := map[string]string{
+		"a": gcp.FAILURE,
+		"b": config.SKIPPED,
+		"c": gcp.SUCCESS,
+		"d": config.SKIPPED,
+		"e": config.REJECTED,
+		"f": config.SKIPPED,
+		"g": gcp.SUCCESS,
+	}
+	for name, expectedStatus := range expectedStatuses {
+		if status := stepStatus(ctx, name); status != expectedStatus {
+			t.Errorf("got status %s for %s, want %s", status, name, expectedStatus)
+		}
+	}
+	succeeded, failed, skipped := countSteps(ctx)
+	if succeeded != 2 || failed != 2 || skipped != 3 {
+		t.Errorf("got %d succeeded, %d failed, %d skipped, want 2, 2, 3", succeeded, failed, skipped)
+	}
+}
+
+func TestRunExitCodes(t *testing.T) {
+	tcs := []struct {
+		name         string
+		approved     bool
+		missing      bool
+		expectedCode int
+	}{
+		{
+			name:         "approved",
+			approved:     true,
+			expectedCode: ExitSuccess,
+		},
+		{
+			name:         "rejected",
+			approved:     false,
+			expectedCode: ExitRejected,
+		},
+		{
+			name:         "missing trigger",
+			approved:     true,
+			missing:      true,
+			expectedCode: ExitOrchestrationError,
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			manual := testStep("b", "a")
+			manual.Manual = true
+			backend := gcp.NewFakeBackend()
+			steps := []config.Step{testStep("a"), manual}
+			if tc.missing {
+				steps = append(steps, config.Step{Name: "c", ProjectId: testProject})
+			}
+			ctx := buildTestContext(t, steps, backend)
+			ctx.options.NoFastFailing = true
+			ctx.approve = func(waitInput WaitInput) bool {
+				return tc.approved
+			}
+
+			if code := run(ctx); code != tc.expectedCode {
+				t.Errorf("got exit code %d, want %d", code, tc.expectedCode)
+			}
+		})
+	}
+}
+
+func TestRunFastFailingRejection(t *testing.T) {
+	manual := testStep("b", "a")
+	manual.Manual = true
+	backend := gcp.NewFakeBackend()
+	ctx := buildTestContext(t, []config.Step{testStep("a"), manual, testStep("c")}, backend)
+	ctx.approve = func(waitInput WaitInput) bool {
+		return false
+	}
+	backend.SetOutcomes(testProject, "a-trigger", gcp.FakeOutcome{Duration: 20 * time.Millisecond})
+	backend.SetOutcomes(testProject, "c-trigger", gcp.FakeOutcome{Duration: time.Minute})
+
+	if code := run(ctx); code != ExitRejected {
+		t.Errorf("got exit code %d, want %d", code, ExitRejected)
+	}
+	if status := stepStatus(ctx, "c"); status != config.ABORTED {
+		t.Errorf("got status %s for c, want %s", status, config.ABORTED)
+	}
+	succeeded, failed, skipped := countSteps(ctx)
+	if succeeded != 1 || failed != 1 || skipped != 1 {
+		t.Errorf("got %d succeeded, %d failed, %d skipped, want 1, 1, 1", succeeded, failed, skipped)
+	}
+}
+
+func TestAbortSteps(t *testing.T) {
+	ctx := buildTestContext(t, []config.Step{testStep("a"), testStep("b"), testStep("c"), testStep("d")}, gcp.NewFakeBackend())
+	for name, status := range map[string]string{"a": gcp.SUCCESS, "b": gcp.WORKING, "c": gcp.RUNNING} {
+		step := ctx.dag.Nodes[name].Task.(config.Step)
+		step.Status = status
+		if name == "b" {
+			step.BuildId = "build-b"
+		}
+		ctx.dag.Nodes[name].Task = step
+	}
+
+	abortSteps(ctx)
+	expected := map[string]string{"a": gcp.SUCCESS, "b": config.ABORTED, "c": config.SKIPPED, "d": ""}
+	for name, expectedStatus := range expected {
+		if status := stepStatus(ctx, name); status != expectedStatus {
+			t.Errorf("got status %q for %s, want %q", status, name, expectedStatus)
+		}
+	}
+	if code := exitCode(ctx); code != ExitSuccess {
+		t.Errorf("got exit code %d, want %d", code, ExitSuccess)
+	}
+}
+
+func TestRunReattachesBuilds(t *testing.T) {
+	backend := gcp.NewFakeBackend()
+	ctx := buildTestContext(t, []config.Step{
+		testStep("a"),
+		testStep("b", "a"),
+		testStep("c", "b"),
+	}, backend)
+	backend.SetOutcomes(testProject, "b-trigger", gcp.FakeOutcome{Duration: 10 * time.Millisecond})
+	build, err := backend.RunTrigger(testProject, gcp.GlobalRegion, "fake-b-trigger", gcp.RepoSource{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := ctx.dag.Nodes["a"].Task.(config.Step)
+	a.Status = gcp.SUCCESS
+	ctx.dag.Nodes["a"].Task = a
+	b := ctx.dag.Nodes["b"].Task.(config.Step)
+	b.Status = gcp.RUNNING
+	b.BuildId = build.ID
+	ctx.dag.Nodes["b"].Task = b
+
+	if code := run(ctx); code != ExitSuccess {
+		t.Errorf("got exit code %d, want %d", code, ExitSuccess)
+	}
+
+	expectedRuns := []string{testProject + "/b-trigger", testProject + "/c-trigger"}
+	if d := cmp.Diff(expectedRuns, backend.Runs()); d != "" {
+		t.Errorf("unexpected runs (-want, +got): %s", d)
+	}
+}
+
+func TestHandleTriggerRetries(t *testing.T) {
+	tcs := []struct {
+		name             string
+		outcomes         []gcp.FakeOutcome
+		expectedErr      bool
+		expectedStatus   string
+		expectedAttempts int
+	}{
+		{
+			name:             "succeeds after retries",
+			outcomes:         []gcp.FakeOutcome{{Status: gcp.FAILURE}, {Status: gcp.INTERNAL_ERROR}, {Status: gcp.SUCCESS}},
+			expectedStatus:   gcp.SUCCESS,
+			expectedAttempts: 3,
+		},
+		{
+			name:             "fails after max attempts",
+			outcomes:         []gcp.FakeOutcome{{Status: gcp.FAILURE}},
+			expectedErr:      true,
+			expectedStatus:   gcp.FAILURE,
+			expectedAttempts: 3,
+		},
+		{
+			name:             "status not retryable",
+			outcomes:         []gcp.FakeOutcome{{Status: gcp.CANCELLED}},
+			expectedErr:      true,
+			expectedStatus:   gcp.CANCELLED,
+			expectedAttempts: 1,
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			step := testStep("a")
+			step.Retry = &config.RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond}
+			backend := gcp.NewFakeBackend()
+			ctx := buildTestContext(t, []config.Step{step}, backend)
+			backend.SetOutcomes(testProject, "a-trigger", tc.outcomes...)
+
+			err := handleTrigger("a", ctx)
+			if (err != nil) != tc.expectedErr {
+				t.Errorf("got error %v, expected error: %v", err, tc.expectedErr)
+			}
+			got := ctx.dag.Nodes["a"].Task.(config.Step)
+			if got.Status != tc.expectedStatus || got.Attempts != tc.expectedAttempts {
+				t.Errorf("got status %s after %d attempts, want %s after %d", got.Status, got.Attempts, tc.expectedStatus, tc.expectedAttempts)
+			}
+			sources := backend.Sources()
+			for _, source := range sources[1:] {
+				if source.CommitSha != backend.CommitSha {
+					t.Errorf("expected retries to be pinned to %s, got %v", backend.CommitSha, source)
+				}
+			}
+		})
+	}
+}
+
+// buildLinkedTestContexts builds the contexts of configs run together, by config name.
+func buildLinkedTestContexts(t *testing.T, configs []config.Config, backend *gcp.FakeBackend) []*executionContext {
+	t.Helper()
+	ctxs := []*executionContext{}
+	for i := range configs {
+		conf := &configs[i]
+		d, err := dag.BuildDag(config.Steps(conf.Steps), conf.GetLinks(config.OtherConfigNames(configs, conf.Name)...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, step := range conf.Steps {
+			backend.AddRegionalTrigger(step.ProjectId, conf.GetRegion(step), step.Trigger)
+		}
+		ctx := newExecutionContext(context.Background(), d, conf, cmd.Options{Reference: "develop", NumParallelJobs: 2}, backend)
+		ctx.pollInterval = time.Millisecond
+		ctx.triggers, err = listTriggers(conf, d, backend)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctxs = append(ctxs, ctx)
+	}
+	linkRuns(ctxs)
+	return ctxs
+}
+
+func TestRunCrossConfigDependencies(t *testing.T) {
+	tcs := []struct {
+		name             string
+		networkOutcome   gcp.FakeOutcome
+		expectedRuns     []string
+		expectedStatuses map[string]string
+	}{
+		{
+			name:           "waits for the step of the other config",
+			networkOutcome: gcp.FakeOutcome{Duration: 20 * time.Millisecond},
+			expectedRuns: []string{
+				testProject + "/network-trigger",
+				testProject + "/deploy-trigger",
+				testProject + "/smoke-trigger",
+			},
+			expectedStatuses: map[string]string{
+				"network": gcp.SUCCESS,
+				"deploy":  gcp.SUCCESS,
+				"smoke":   gcp.SUCCESS,
+			},
+		},
+		{
+			name:           "skips the steps depending on a failed step of the other config",
+			networkOutcome: gcp.FakeOutcome{Status: gcp.FAILURE, Duration: 20 * time.Millisecond},
+			expectedRuns:   []string{testProject + "/network-trigger"},
+			expectedStatuses: map[string]string{
+				"network": gcp.FAILURE,
+				"deploy":  config.SKIPPED,
+				"smoke":   config.SKIPPED,
+			},
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			backend := gcp.NewFakeBackend()
+			ctxs := buildLinkedTestContexts(t, []config.Config{
+				{Name: "app", Steps: []config.Step{testStep("deploy", "platform:network"), testStep("smoke", "deploy")}},
+				{Name: "platform", Steps: []config.Step{testStep("network")}},
+			}, backend)
+			backend.SetOutcomes(testProject, "network-trigger", tc.networkOutcome)
+
+			done := make(chan struct{})
+			for _, ctx := range ctxs {
+				go func(ctx *executionContext) {
+					run(ctx)
+					done <- struct{}{}
+				}(ctx)
+			}
+			for range ctxs {
+				select {
+				case <-done:
+				case <-time.After(5 * time.Second):
+					t.Fatal("the runs didn't end")
+				}
+			}
+
+			if d := cmp.Diff(tc.expectedRuns, backend.Runs()); d != "" {
+				t.Errorf("unexpected runs (-want, +got): %s", d)
+			}
+			statuses := map[string]string{
+				"deploy":  stepStatus(ctxs[0], "deploy"),
+				"smoke":   stepStatus(ctxs[0], "smoke"),
+				"network": stepStatus(ctxs[1], "network"),
+			}
+			if d := cmp.Diff(tc.expectedStatuses, statuses); d != "" {
+				t.Errorf("unexpected statuses (-want, +got): %s", d)
+			}
+		})
+	}
+}
+
+func TestLinkRunsOf(t *testing.T) {
+	ctxs := buildLinkedTestContexts(t, []config.Config{
+		{Name: "app", Steps: []config.Step{testStep("deploy", "platform:network")}},
+		{Name: "platform", Steps: []config.Step{testStep("network")}},
+		{Name: "docs", Steps: []config.Step{testStep("publish")}},
+	}, gcp.NewFakeBackend())
+
+	linked := map[*executionContext]bool{}
+	linkRunsOf(ctxs[0], linked)
+	if !linked[ctxs[0]] || !linked[ctxs[1]] || linked[ctxs[2]] {
+		t.Errorf("got linked runs %v, want app and platform only", linked)
+	}
+}
+
+func TestLogTriggerName(t *testing.T) {
+	conf := &config.Config{Name: "app", Steps: []config.Step{
+		{Name: "build", Trigger: "build"},
+		{Name: "deploy (europe-west1)", Trigger: "deploy", ProjectId: "app-europe-west1"},
+		{Name: "deploy (us-central1)", Trigger: "deploy", ProjectId: "app-us-central1"},
+	}}
+	expected := []string{"app/build", "app/deploy (europe-west1)", "app/deploy (us-central1)"}
+	for i, step := range conf.Steps {
+		if name := logTriggerName(conf, step); name != expected[i] {
+			t.Errorf("got %s for %s, want %s", name, step.Name, expected[i])
+		}
+	}
+}
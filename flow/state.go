@@ -0,0 +1,198 @@
+package flow
+
+import (
+	"cork/cmd"
+	"cork/config"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+var nonAlphanumericRegex = regexp.MustCompile("[^a-z0-9]+")
+
+// RunState is the progress of a config run, saved as the run goes so that it can be resumed.
+type RunState struct {
+	RunId      string `yaml:"run-id"`
+	ConfigFile string `yaml:"config-file"`
+	ConfigHash string `yaml:"config-hash"`
+	Reference  string `yaml:"reference"`
+	CommitSha  string `yaml:"commit-sha,omitempty"`
+	// Substitutions are the substitutions given on the command line.
+	Substitutions map[string]string `yaml:"substitutions,omitempty"`
+	// Rehearse is set for the runs against the fake backend, whose builds and commit don't
+	// exist in Cloud Build, so that they are resumed as rehearsals only.
+	Rehearse bool          `yaml:"rehearse,omitempty"`
+	Config   config.Config `yaml:"config"`
+	path     string
+	// saved is set once the state was written, the first write failing when a state exists.
+	saved bool
+	lock  sync.Mutex
+}
+
+// hashConfigFile hashes the config file along with the files it includes, resolved
+// relative to it.
+func hashConfigFile(path string) (string, error) {
+	hash := sha256.New()
+	for _, file := range config.SourceFiles(path) {
+		source, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		hash.Write(source)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// NewRunState creates the state of a new run of conf with options, saved in their state directory.
+// The config file is recorded by its absolute path, for the run to be resumed from any directory.
+// The run ID is the start time and the slug of the config name, suffixed with a counter when
+// another run already has it, the state of another run never being overwritten.
+func NewRunState(conf config.Config, options cmd.Options) (*RunState, error) {
+	configFile, err := filepath.Abs(conf.ConfigFile)
+	if err != nil {
+		return nil, err
+	}
+	conf.ConfigFile = configFile
+	hash, err := hashConfigFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+	slug := strings.Trim(nonAlphanumericRegex.ReplaceAllString(strings.ToLower(conf.Name), "-"), "-")
+	baseRunId := time.Now().Format("20060102-150405") + "-" + slug
+	for n := 1; ; n++ {
+		runId := baseRunId
+		if n > 1 {
+			runId = fmt.Sprintf("%s-%d", baseRunId, n)
+		}
+		state := &RunState{
+			RunId:         runId,
+			ConfigFile:    configFile,
+			ConfigHash:    hash,
+			Reference:     options.Reference,
+			Substitutions: options.Substitutions,
+			Rehearse:      options.Rehearse,
+			Config:        conf,
+			path:          filepath.Join(options.StateDir, runId+".yaml"),
+		}
+		if reserveStatePath(state.path) {
+			return state, nil
+		}
+	}
+}
+
+var (
+	reservedLock  sync.Mutex
+	reservedPaths = map[string]bool{}
+)
+
+// reserveStatePath tells whether the state of a new run can be saved at path, reserving
+// it: no state exists there and no other run of the process reserved it.
+func reserveStatePath(path string) bool {
+	reservedLock.Lock()
+	defer reservedLock.Unlock()
+	if reservedPaths[path] {
+		return false
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		return false
+	}
+	reservedPaths[path] = true
+	return true
+}
+
+// LoadRunState reads the state of a previous run and prepares it to be resumed: successful
+// steps are kept, steps with a build still running are reattached and the others are reset.
+// A rehearsal is resumed as a rehearsal only.
+func LoadRunState(path string, rehearse bool) (*RunState, error) {
+	source, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	state := &RunState{path: path, saved: true}
+	if err := yaml.Unmarshal(source, state); err != nil {
+		return nil, fmt.Errorf("invalid run state %s: %w", path, err)
+	}
+	if state.Rehearse && !rehearse {
+		return nil, fmt.Errorf("run %s can't be resumed: it was a rehearsal, resume it with -rehearse", state.RunId)
+	}
+	state.Config.ConfigFile = state.ConfigFile
+
+	hash, err := hashConfigFile(state.ConfigFile)
+	if err != nil {
+		return nil, fmt.Errorf("run %s can't be resumed: %w", state.RunId, err)
+	}
+	if hash != state.ConfigHash {
+		return nil, fmt.Errorf("run %s can't be resumed: %s changed since the run started", state.RunId, state.ConfigFile)
+	}
+
+	for i, step := range state.Config.Steps {
+		if step.IsSuccessful() || (step.HasStarted() && !step.HasFinished() && step.BuildId != "") {
+			continue
+		}
+		state.Config.Steps[i] = step.Reset()
+	}
+	return state, nil
+}
+
+func (state *RunState) Path() string {
+	return state.path
+}
+
+func (state *RunState) save() error {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	out, err := yaml.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(state.path), 0755); err != nil {
+		return err
+	}
+	tmp := state.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, out, 0644); err != nil {
+		return err
+	}
+	if state.saved {
+		return os.Rename(tmp, state.path)
+	}
+	// Unlike a rename, a link never replaces the state of another run.
+	defer os.Remove(tmp)
+	if err := os.Link(tmp, state.path); os.IsExist(err) {
+		return fmt.Errorf("run state %s already exists", state.path)
+	} else if err != nil {
+		return err
+	}
+	state.saved = true
+	return nil
+}
+
+// saveState copies the progress of the run into its state and writes it.
+func saveState(ctx *executionContext) {
+	if ctx.state == nil {
+		return
+	}
+	func() {
+		ctx.lock.Lock()
+		defer ctx.lock.Unlock()
+		ctx.state.lock.Lock()
+		defer ctx.state.lock.Unlock()
+		ctx.state.CommitSha = ctx.exactRef
+		for i, step := range ctx.state.Config.Steps {
+			if node, ok := ctx.dag.Nodes[step.Name]; ok {
+				ctx.state.Config.Steps[i] = node.Task.(config.Step)
+			}
+		}
+	}()
+	if err := ctx.state.save(); err != nil {
+		flowLog(Log{Message: "couldn't save the run state: " + err.Error(), Progress: SKIP})
+	}
+}
@@ -0,0 +1,194 @@
+package flow
+
+import (
+	"cork/cmd"
+	"cork/config"
+	"cork/gcp"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func writeTestConfig(t *testing.T, dir string, content string) config.Config {
+	t.Helper()
+	path := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return config.Config{
+		ConfigFile: path,
+		Name:       "test",
+		Steps: []config.Step{
+			{Name: "a", Status: gcp.SUCCESS, BuildId: "build-a", LogUrl: "url-a"},
+			{Name: "b", Status: gcp.RUNNING, BuildId: "build-b", LogUrl: "url-b"},
+			{Name: "c", Status: gcp.FAILURE, BuildId: "build-c", LogUrl: "url-c"},
+			{Name: "d", Status: config.SKIPPED},
+			{Name: "e", Status: gcp.RUNNING},
+		},
+	}
+}
+
+func TestLoadRunState(t *testing.T) {
+	dir := t.TempDir()
+	conf := writeTestConfig(t, dir, "name: test")
+	state, err := NewRunState(conf, cmd.Options{Reference: "develop", StateDir: filepath.Join(dir, "state")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.CommitSha = "0123456"
+	if err := state.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadRunState(state.Path(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.RunId != state.RunId || loaded.CommitSha != "0123456" || loaded.Reference != "develop" {
+		t.Errorf("got run %s pinned to %s from %s, want %s pinned to 0123456 from develop", loaded.RunId, loaded.CommitSha, loaded.Reference, state.RunId)
+	}
+	expected := []config.Step{
+		{Name: "a", Status: gcp.SUCCESS, BuildId: "build-a", LogUrl: "url-a"},
+		{Name: "b", Status: gcp.RUNNING, BuildId: "build-b", LogUrl: "url-b"},
+		{Name: "c"},
+		{Name: "d"},
+		{Name: "e"},
+	}
+	if d := cmp.Diff(expected, loaded.Config.Steps); d != "" {
+		t.Errorf("unexpected resumed steps (-want, +got): %s", d)
+	}
+}
+
+func TestLoadRunStateChangedConfig(t *testing.T) {
+	dir := t.TempDir()
+	conf := writeTestConfig(t, dir, "name: test")
+	state, err := NewRunState(conf, cmd.Options{Reference: "develop", StateDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := state.save(); err != nil {
+		t.Fatal(err)
+	}
+	writeTestConfig(t, dir, "name: changed")
+
+	_, err = LoadRunState(state.Path(), false)
+	if err == nil || !strings.Contains(err.Error(), "changed since the run started") {
+		t.Errorf("expected an error for a changed config, got %v", err)
+	}
+}
+
+func TestLoadRunStateRehearsal(t *testing.T) {
+	dir := t.TempDir()
+	conf := writeTestConfig(t, dir, "name: test")
+	state, err := NewRunState(conf, cmd.Options{Reference: "develop", StateDir: dir, Rehearse: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := state.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = LoadRunState(state.Path(), false)
+	if err == nil || !strings.Contains(err.Error(), "it was a rehearsal, resume it with -rehearse") {
+		t.Errorf("expected an error for a rehearsal resumed against Cloud Build, got %v", err)
+	}
+	if _, err := LoadRunState(state.Path(), true); err != nil {
+		t.Errorf("unexpected error resuming the rehearsal: %s", err)
+	}
+}
+
+func TestLoadRunStateFromAnotherDirectory(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"common.yaml": "substitutions:\n  _ENV: dev\n",
+		"config.yaml": "name: test\ninclude:\n  - common.yaml\nsteps:\n  - name: a\n    trigger: a\n    project-id: p\n",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	state, err := NewRunState(config.Config{ConfigFile: "config.yaml", Name: "test"}, cmd.Options{StateDir: filepath.Join(dir, "state")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := state.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadRunState(filepath.Join(dir, "state", filepath.Base(state.Path())), false); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "common.yaml"), []byte("substitutions:\n  _ENV: prod\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = LoadRunState(filepath.Join(dir, "state", filepath.Base(state.Path())), false)
+	if err == nil || !strings.Contains(err.Error(), "changed since the run started") {
+		t.Errorf("expected an error for a changed include, got %v", err)
+	}
+}
+
+func TestNewRunStateUniqueRunIds(t *testing.T) {
+	dir := t.TempDir()
+	options := cmd.Options{Reference: "develop", StateDir: filepath.Join(dir, "state")}
+	paths := map[string]bool{}
+	for _, name := range []string{"my app", "my-app", "My App", "my app"} {
+		conf := writeTestConfig(t, dir, "name: "+name)
+		state, err := NewRunState(conf, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if paths[state.Path()] {
+			t.Errorf("run state %s of %s is the state of another run", state.Path(), name)
+		}
+		paths[state.Path()] = true
+		if err := state.save(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, err := ioutil.ReadDir(options.StateDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != len(paths) {
+		t.Errorf("got %d run states, want %d", len(files), len(paths))
+	}
+}
+
+func TestSaveRunStateNeverOverwrites(t *testing.T) {
+	dir := t.TempDir()
+	conf := writeTestConfig(t, dir, "name: test")
+	state, err := NewRunState(conf, cmd.Options{Reference: "develop", StateDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Another cork process saves its run under the same ID meanwhile.
+	if err := ioutil.WriteFile(state.Path(), []byte("run-id: other\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := state.save(); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Errorf("expected an error for an existing run state, got %v", err)
+	}
+	if content, err := ioutil.ReadFile(state.Path()); err != nil || string(content) != "run-id: other\n" {
+		t.Errorf("the run state of the other run was overwritten: %q", content)
+	}
+	if _, err := os.Stat(state.Path() + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("expected the temporary run state to be removed, got %v", err)
+	}
+}
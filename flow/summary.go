@@ -0,0 +1,129 @@
+package flow
+
+import (
+	"cork/config"
+	"cork/gcp"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// Process exit codes, from the least to the most severe.
+const (
+	ExitSuccess            = 0
+	ExitRejected           = 3
+	ExitBuildFailure       = 1
+	ExitOrchestrationError = 2
+	ExitInterrupted        = 130
+)
+
+var exitCodeSeverity = []int{ExitSuccess, ExitRejected, ExitBuildFailure, ExitOrchestrationError, ExitInterrupted}
+
+// worstExitCode returns the most severe of two exit codes.
+func worstExitCode(a int, b int) int {
+	for _, code := range exitCodeSeverity {
+		if code == a {
+			return b
+		}
+		if code == b {
+			return a
+		}
+	}
+	return a
+}
+
+func stepExitCode(step config.Step) int {
+	switch step.Status {
+	case gcp.SUCCESS, config.SKIPPED, config.ABORTED, "":
+		return ExitSuccess
+	case config.REJECTED:
+		return ExitRejected
+	case config.ERROR:
+		return ExitOrchestrationError
+	default:
+		return ExitBuildFailure
+	}
+}
+
+// exitCode returns the exit code matching the outcome of a run.
+func exitCode(ctx *executionContext) int {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	code := ExitSuccess
+	if ctx.interrupted {
+		code = ExitInterrupted
+	} else if ctx.orchestrationError {
+		code = ExitOrchestrationError
+	}
+	for _, node := range ctx.dag.Nodes {
+		code = worstExitCode(code, stepExitCode(node.Task.(config.Step)))
+	}
+	return code
+}
+
+func formatDuration(duration time.Duration) string {
+	if duration == 0 {
+		return "-"
+	}
+	return duration.Round(time.Second).String()
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// printSummary prints the final status of every step of the runs, in the config order,
+// the steps being prefixed by the name of their config when there are several runs.
+func printSummary(ctxs []*executionContext) {
+	names := []string{}
+	steps := []config.Step{}
+	succeeded, failed, skipped := 0, 0, 0
+	for _, ctx := range ctxs {
+		ctx.lock.Lock()
+		for _, confStep := range ctx.conf.Steps {
+			if node, ok := ctx.dag.Nodes[confStep.Name]; ok {
+				name := confStep.Name
+				if len(ctxs) > 1 {
+					name = ctx.conf.Name + "/" + name
+				}
+				names = append(names, name)
+				steps = append(steps, node.Task.(config.Step))
+			}
+		}
+		ctx.lock.Unlock()
+
+		ctxSucceeded, ctxFailed, ctxSkipped := countSteps(ctx)
+		succeeded += ctxSucceeded
+		failed += ctxFailed
+		skipped += ctxSkipped
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(ctxs) == 1 {
+		fmt.Printf("# %s summary:\n", ctxs[0].conf.Name)
+	} else {
+		fmt.Println("# summary:")
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "STEP\tSTATUS\tDURATION\tCOMMIT\tLOG")
+	for i, step := range steps {
+		status := step.Status
+		if !step.HasStarted() {
+			status = config.SKIPPED
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+			names[i],
+			status,
+			formatDuration(step.Duration),
+			orDash(step.CommitSha),
+			orDash(step.LogUrl),
+		)
+	}
+	w.Flush()
+	fmt.Printf("%d succeeded, %d failed, %d skipped\n", succeeded, failed, skipped)
+}
@@ -0,0 +1,45 @@
+package flow
+
+import "testing"
+
+func TestWorstExitCode(t *testing.T) {
+	tcs := []struct {
+		name     string
+		a        int
+		b        int
+		expected int
+	}{
+		{
+			name:     "success",
+			a:        ExitSuccess,
+			b:        ExitSuccess,
+			expected: ExitSuccess,
+		},
+		{
+			name:     "failure over rejection",
+			a:        ExitRejected,
+			b:        ExitBuildFailure,
+			expected: ExitBuildFailure,
+		},
+		{
+			name:     "orchestration error over failure",
+			a:        ExitOrchestrationError,
+			b:        ExitBuildFailure,
+			expected: ExitOrchestrationError,
+		},
+		{
+			name:     "interruption over everything",
+			a:        ExitOrchestrationError,
+			b:        ExitInterrupted,
+			expected: ExitInterrupted,
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := worstExitCode(tc.a, tc.b); got != tc.expected {
+				t.Errorf("got %d, want %d", got, tc.expected)
+			}
+		})
+	}
+}
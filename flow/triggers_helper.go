@@ -1,9 +1,13 @@
 package flow
 
 import (
+	"cork/config"
 	"cork/gcp"
 	"cork/utils"
+	"fmt"
 	"regexp"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -11,6 +15,10 @@ const (
 	gitShaRegex = "^[0-9a-f]{5,40}$"
 )
 
+// substitutionRegex matches the references to user-defined substitutions, $_NAME or
+// ${_NAME}, an even number of $ escaping them.
+var substitutionRegex = regexp.MustCompile(`(\$+)\{?(_[A-Z0-9_]+)`)
+
 func setExactRef(exactRef *string, build *gcp.BuildOperation) {
 	if matched, _ := regexp.MatchString(gitShaRegex, *exactRef); !matched {
 		*exactRef = build.CommitSha
@@ -28,6 +36,72 @@ func getSourceRepo(ref string) gcp.RepoSource {
 	}
 }
 
+// runSubstitutions returns the substitutions the trigger of step is run with, see
+// config.Config.GetSubstitutions, triggers being the triggers of the run.
+func runSubstitutions(conf *config.Config, step config.Step, overrides map[string]string, triggers map[string]*gcp.BuildTrigger) map[string]string {
+	declared := map[string]string{}
+	if buildTrigger := triggers[conf.GetTriggerKey(step)]; buildTrigger != nil {
+		declared = buildTrigger.Substitutions
+	}
+	return conf.GetSubstitutions(step, overrides, declared)
+}
+
+// validateSubstitutions checks that the trigger declares every substitution it's run with.
+func validateSubstitutions(buildTrigger *gcp.BuildTrigger, substitutions map[string]string) error {
+	undeclared := []string{}
+	for key := range substitutions {
+		if _, ok := buildTrigger.Substitutions[key]; !ok {
+			undeclared = append(undeclared, key)
+		}
+	}
+	if len(undeclared) == 0 {
+		return nil
+	}
+	sort.Strings(undeclared)
+	return fmt.Errorf("trigger %s doesn't declare the substitutions %s", buildTrigger.Name, strings.Join(undeclared, ", "))
+}
+
+// checkRequiredSubstitutions returns an error when the build defined inline by the trigger
+// references substitutions neither declared by the trigger or the build nor given by the
+// step. The builds defined by a file of the repository aren't known before they start.
+func checkRequiredSubstitutions(buildTrigger *gcp.BuildTrigger, substitutions map[string]string) error {
+	build := buildTrigger.Build
+	if build == nil {
+		return nil
+	}
+	texts := append(append([]string{}, build.Images...), build.Tags...)
+	for _, step := range build.Steps {
+		texts = append(texts, step.Name, step.Entrypoint, step.Dir, step.Script)
+		texts = append(append(texts, step.Args...), step.Env...)
+	}
+	if build.Artifacts != nil {
+		texts = append(texts, build.Artifacts.Images...)
+		if build.Artifacts.Objects != nil {
+			texts = append(append(texts, build.Artifacts.Objects.Location), build.Artifacts.Objects.Paths...)
+		}
+	}
+	missing := []string{}
+	for _, text := range texts {
+		for _, match := range substitutionRegex.FindAllStringSubmatch(text, -1) {
+			if len(match[1])%2 == 0 {
+				continue
+			}
+			key := match[2]
+			_, declared := buildTrigger.Substitutions[key]
+			_, defined := build.Substitutions[key]
+			_, given := substitutions[key]
+			if !declared && !defined && !given && !utils.Contains(missing, key) {
+				missing = append(missing, key)
+			}
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	sort.Strings(missing)
+	return fmt.Errorf("the build of trigger %s requires the substitutions %s", buildTrigger.Name, strings.Join(missing, ", "))
+}
+
 func getRef(cloudBuildRef string, exactRef string) string {
 	if exactRef == "" {
 		return cloudBuildRef
@@ -35,23 +109,46 @@ func getRef(cloudBuildRef string, exactRef string) string {
 	return exactRef
 }
 
-func waitForBuild(projectId string, buildId string) (string, error) {
-	ticker := time.NewTicker(5 * time.Second)
+// waitForBuild polls the build until it ends, logging when it's queued and when it starts working.
+func waitForBuild(ctx *executionContext, step *config.Step, build trackedBuild) (string, error) {
+	ticker := time.NewTicker(ctx.pollInterval)
 	defer ticker.Stop()
 	retries := 3
 	var retErr error = nil
-	for range ticker.C {
-		status, err := gcp.GetBuild(projectId, buildId)
+	lastChange := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.runCtx.Done():
+			return "", errAborted
+		}
+		status, err := ctx.backend.GetBuild(build.ProjectId, build.Region, build.BuildId)
 		if err != nil {
 			if retries == 0 {
 				retErr = err
 				break
 			}
 			retries -= 1
+			continue
 		}
-		if utils.Contains([]string{gcp.SUCCESS, gcp.FAILURE, gcp.CANCELLED}, status) {
+		if gcp.IsFinal(status) {
 			return status, nil
 		}
+		if status != step.Status {
+			message := strings.ToLower(status)
+			if step.Status == gcp.QUEUED {
+				message += " after being queued for " + time.Since(lastChange).Round(time.Second).String()
+			}
+			flowLog(Log{
+				Trigger:  build.Trigger,
+				Message:  message,
+				LogUrl:   build.LogUrl,
+				Progress: status,
+			})
+			lastChange = time.Now()
+			step.Status = status
+			setStep(ctx, *step)
+		}
 	}
 	return "", retErr
 }
@@ -0,0 +1,14 @@
+package gcp
+
+// Backend is the set of build operations the orchestrator relies on, region being
+// GlobalRegion for the triggers and builds not bound to a region.
+// CloudBuild is the production implementation, FakeBackend an in-memory one.
+type Backend interface {
+	ListTriggers(projectId string, region string) (map[string]*BuildTrigger, error)
+	RunTrigger(projectId string, region string, triggerId string, repoSource RepoSource) (*BuildOperation, error)
+	GetBuild(projectId string, region string, buildId string) (string, error)
+	GetBuildOutputs(projectId string, region string, buildId string) (map[string]string, error)
+	CancelBuild(projectId string, region string, buildId string) error
+	HasPermission(projectId string, permission string) (bool, error)
+	HasBranch(projectId string, trigger *BuildTrigger, branch string) (bool, error)
+}
@@ -1,23 +1,77 @@
 package gcp
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
-	"log"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
 	"time"
 
 	"google.golang.org/api/cloudbuild/v1"
+	"google.golang.org/api/cloudresourcemanager/v1"
 	"google.golang.org/api/googleapi"
 )
 
+// Build statuses of the Cloud Build API, RUNNING being the status of a step
+// handled by cork whose build isn't known yet.
 const (
-	RUNNING   = "RUNNING"
-	SUCCESS   = "SUCCESS"
-	FAILURE   = "FAILURE"
-	CANCELLED = "CANCELLED"
+	RUNNING        = "RUNNING"
+	STATUS_UNKNOWN = "STATUS_UNKNOWN"
+	PENDING        = "PENDING"
+	QUEUED         = "QUEUED"
+	WORKING        = "WORKING"
+	SUCCESS        = "SUCCESS"
+	FAILURE        = "FAILURE"
+	INTERNAL_ERROR = "INTERNAL_ERROR"
+	TIMEOUT        = "TIMEOUT"
+	CANCELLED      = "CANCELLED"
+	EXPIRED        = "EXPIRED"
 )
 
+// FinalStatuses are the statuses of the builds that won't change anymore.
+var FinalStatuses = []string{SUCCESS, FAILURE, INTERNAL_ERROR, TIMEOUT, CANCELLED, EXPIRED}
+
+// FailureStatuses are the final statuses of the builds that didn't succeed.
+var FailureStatuses = []string{FAILURE, INTERNAL_ERROR, TIMEOUT, CANCELLED, EXPIRED}
+
+// IsFinal tells whether a build with the status has ended.
+func IsFinal(status string) bool {
+	for _, finalStatus := range FinalStatuses {
+		if status == finalStatus {
+			return true
+		}
+	}
+	return false
+}
+
+// GlobalRegion is the location of the triggers and builds not bound to a region.
+const GlobalRegion = "global"
+
+// TriggerKey identifies a trigger, as project/name for a global trigger and as
+// project/region/name for a regional one.
+func TriggerKey(projectId string, region string, name string) string {
+	if normalizeRegion(region) == GlobalRegion {
+		return projectId + "/" + name
+	}
+	return projectId + "/" + region + "/" + name
+}
+
+func normalizeRegion(region string) string {
+	if region == "" {
+		return GlobalRegion
+	}
+	return region
+}
+
+func locationName(projectId string, region string) string {
+	return "projects/" + projectId + "/locations/" + normalizeRegion(region)
+}
+
 type BuildTrigger = cloudbuild.BuildTrigger
 
 type RepoSource = cloudbuild.RepoSource
@@ -89,18 +143,102 @@ type BuildOperation struct {
 	CommitSha string
 }
 
-// TriggerCloudBuild triggers a GCP Cloudbuild.
-func TriggerCloudBuild(projectId string, triggerId string, repoSource RepoSource) (*BuildOperation, error) {
+// BuildsCreatePermission is the permission needed to run the triggers of a project.
+const BuildsCreatePermission = "cloudbuild.builds.create"
+
+// CloudBuild is the Backend talking to the Google Cloud Build API.
+type CloudBuild struct {
+	service         *cloudbuild.Service
+	resourceManager *cloudresourcemanager.Service
+}
+
+// NewCloudBuild creates a Cloud Build backend using the application default credentials.
+func NewCloudBuild() (*CloudBuild, error) {
 	ctx := context.Background()
-	cloudbuildService, _ := cloudbuild.NewService(ctx)
-	operation, err := cloudbuildService.Projects.Triggers.Run(projectId, triggerId, &repoSource).Do()
-	if apiErr, ok := err.(*googleapi.Error); ok {
-		buildOperationError := CloudBuildOperationError{}
-		json.Unmarshal([]byte(apiErr.Body), &buildOperationError)
-		return nil, errors.New(buildOperationError.Error.Message)
+	cloudbuildService, err := cloudbuild.NewService(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resourceManagerService, err := cloudresourcemanager.NewService(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &CloudBuild{service: cloudbuildService, resourceManager: resourceManagerService}, nil
+}
+
+// HasPermission tells whether the caller has the permission on the project.
+func (c *CloudBuild) HasPermission(projectId string, permission string) (bool, error) {
+	response, err := c.resourceManager.Projects.TestIamPermissions(projectId, &cloudresourcemanager.TestIamPermissionsRequest{
+		Permissions: []string{permission},
+	}).Do()
+	if err != nil {
+		return false, apiError(err)
+	}
+	for _, granted := range response.Permissions {
+		if granted == permission {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// triggerRepository returns the URL of the repository the trigger of the project builds,
+// empty when it isn't known.
+func triggerRepository(projectId string, trigger *BuildTrigger) string {
+	switch {
+	case trigger.Github != nil && trigger.Github.Owner != "" && trigger.Github.Name != "":
+		return "https://github.com/" + trigger.Github.Owner + "/" + trigger.Github.Name
+	case trigger.TriggerTemplate != nil && trigger.TriggerTemplate.RepoName != "":
+		if trigger.TriggerTemplate.ProjectId != "" {
+			projectId = trigger.TriggerTemplate.ProjectId
+		}
+		return "https://source.developers.google.com/p/" + projectId + "/r/" + trigger.TriggerTemplate.RepoName
+	case trigger.SourceToBuild != nil:
+		return trigger.SourceToBuild.Uri
+	}
+	return ""
+}
+
+// HasBranch tells whether the branch exists in the repository the trigger of the project
+// builds. The Cloud Build API can't list the references of a repository, so they're
+// listed by git, with the credentials it's configured with.
+func (c *CloudBuild) HasBranch(projectId string, trigger *BuildTrigger, branch string) (bool, error) {
+	repository := triggerRepository(projectId, trigger)
+	if repository == "" {
+		return false, errors.New("the repository of trigger " + trigger.Name + " is unknown")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	command := exec.CommandContext(ctx, "git", "ls-remote", "--exit-code", "--heads", repository, branch)
+	command.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	stderr := bytes.Buffer{}
+	command.Stderr = &stderr
+	err := command.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 2 {
+		// --exit-code makes git exit with 2 when no reference matches.
+		return false, nil
+	} else if err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return false, errors.New(message)
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// RunTrigger triggers a GCP Cloudbuild.
+func (c *CloudBuild) RunTrigger(projectId string, region string, triggerId string, repoSource RepoSource) (*BuildOperation, error) {
+	operation, err := c.service.Projects.Locations.Triggers.Run(
+		locationName(projectId, region)+"/triggers/"+triggerId,
+		&cloudbuild.RunBuildTriggerRequest{ProjectId: projectId, TriggerId: triggerId, Source: &repoSource},
+	).Do()
+	if err != nil {
+		return nil, apiError(err)
 	}
 	buildOperationMetadata := BuildOperationMetadata{}
-	json.Unmarshal(operation.Metadata, &buildOperationMetadata)
+	if err := json.Unmarshal(operation.Metadata, &buildOperationMetadata); err != nil {
+		return nil, fmt.Errorf("invalid metadata of the build operation: %w", err)
+	}
 	return &BuildOperation{
 		ID:        buildOperationMetadata.Build.ID,
 		LogURL:    buildOperationMetadata.Build.LogURL,
@@ -108,36 +246,108 @@ func TriggerCloudBuild(projectId string, triggerId string, repoSource RepoSource
 	}, nil
 }
 
-func ListTriggers(projectId string) map[string]*BuildTrigger {
-	buildTriggers := make(map[string]*BuildTrigger)
-	ctx := context.Background()
-	cloudbuildService, _ := cloudbuild.NewService(ctx)
-
-	operation, err := cloudbuildService.Projects.Triggers.List(projectId).Do()
-	// Google API verbose debugging info.
-	if apiErr, ok := err.(*googleapi.Error); ok {
-		log.Println(apiErr.Body)
+// apiError returns the message of a Google API error, err itself for other errors.
+func apiError(err error) error {
+	apiErr, ok := err.(*googleapi.Error)
+	if !ok {
+		return err
 	}
+	buildOperationError := CloudBuildOperationError{}
+	if json.Unmarshal([]byte(apiErr.Body), &buildOperationError) != nil || buildOperationError.Error.Message == "" {
+		return err
+	}
+	return errors.New(buildOperationError.Error.Message)
+}
 
-	for _, trigger := range operation.Triggers {
-		buildTriggers[projectId+"/"+trigger.Name] = trigger
+// ListTriggers returns every trigger of the project in the region, by TriggerKey.
+func (c *CloudBuild) ListTriggers(projectId string, region string) (map[string]*BuildTrigger, error) {
+	buildTriggers := make(map[string]*BuildTrigger)
+	err := c.service.Projects.Locations.Triggers.List(locationName(projectId, region)).Pages(
+		context.Background(),
+		func(page *cloudbuild.ListBuildTriggersResponse) error {
+			for _, trigger := range page.Triggers {
+				buildTriggers[TriggerKey(projectId, region, trigger.Name)] = trigger
+			}
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, apiError(err)
 	}
+	return buildTriggers, nil
+}
 
-	return buildTriggers
+func (c *CloudBuild) GetBuild(projectId string, region string, buildId string) (string, error) {
+	build, err := c.service.Projects.Locations.Builds.Get(locationName(projectId, region) + "/builds/" + buildId).Do()
+	if err != nil {
+		return "", apiError(err)
+	}
+	return build.Status, nil
 }
 
-func GetBuild(projectId string, buildId string) (string, error) {
-	ctx := context.Background()
-	cloudbuildService, _ := cloudbuild.NewService(ctx)
+// BuildOutputs returns what a build produced, as referenced by the steps depending on it:
+// commit_sha, image and image_digest for the first image, images.N.name and images.N.digest,
+// build_step_outputs.N, artifact_manifest, artifacts_location and artifacts.N.path.
+func BuildOutputs(build *cloudbuild.Build) map[string]string {
+	outputs := map[string]string{}
+	commitSha := build.Substitutions["REVISION_ID"]
+	if commitSha == "" && build.SourceProvenance != nil && build.SourceProvenance.ResolvedRepoSource != nil {
+		commitSha = build.SourceProvenance.ResolvedRepoSource.CommitSha
+	}
+	if commitSha != "" {
+		outputs["commit_sha"] = commitSha
+	}
+	if build.Artifacts != nil && build.Artifacts.Objects != nil {
+		if build.Artifacts.Objects.Location != "" {
+			outputs["artifacts_location"] = build.Artifacts.Objects.Location
+		}
+		for i, path := range build.Artifacts.Objects.Paths {
+			outputs[fmt.Sprintf("artifacts.%d.path", i)] = path
+		}
+	}
+	if build.Results == nil {
+		return outputs
+	}
+	for i, image := range build.Results.Images {
+		if i == 0 {
+			outputs["image"] = image.Name
+			outputs["image_digest"] = image.Digest
+		}
+		outputs[fmt.Sprintf("images.%d.name", i)] = image.Name
+		outputs[fmt.Sprintf("images.%d.digest", i)] = image.Digest
+	}
+	for i, output := range build.Results.BuildStepOutputs {
+		// Build step outputs are base64 encoded, empty for the steps not writing any.
+		decoded, err := base64.StdEncoding.DecodeString(output)
+		if err != nil || len(decoded) == 0 {
+			continue
+		}
+		outputs[fmt.Sprintf("build_step_outputs.%d", i)] = strings.TrimSpace(string(decoded))
+	}
+	if build.Results.ArtifactManifest != "" {
+		outputs["artifact_manifest"] = build.Results.ArtifactManifest
+	}
+	return outputs
+}
 
-	operation, err := cloudbuildService.Projects.Builds.Get(projectId, buildId).Do()
-	// Google API verbose debugging info.
-	if apiErr, ok := err.(*googleapi.Error); ok {
-		log.Println(apiErr.Body)
-		buildOperationError := CloudBuildOperationError{}
-		json.Unmarshal([]byte(apiErr.Body), &buildOperationError)
-		return "", errors.New(buildOperationError.Error.Message)
+// GetBuildOutputs returns the outputs of a finished build, see BuildOutputs.
+func (c *CloudBuild) GetBuildOutputs(projectId string, region string, buildId string) (map[string]string, error) {
+	build, err := c.service.Projects.Locations.Builds.Get(locationName(projectId, region) + "/builds/" + buildId).Do()
+	if err != nil {
+		return nil, apiError(err)
 	}
+	return BuildOutputs(build), nil
+}
 
-	return operation.Status, nil
+func (c *CloudBuild) CancelBuild(projectId string, region string, buildId string) error {
+	name := locationName(projectId, region) + "/builds/" + buildId
+	_, err := c.service.Projects.Locations.Builds.Cancel(name, &cloudbuild.CancelBuildRequest{
+		Name:      name,
+		ProjectId: projectId,
+		Id:        buildId,
+	}).Do()
+	if err != nil {
+		return apiError(err)
+	}
+	return nil
 }
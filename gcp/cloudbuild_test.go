@@ -0,0 +1,111 @@
+package gcp
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/api/cloudbuild/v1"
+)
+
+func TestTriggerRepository(t *testing.T) {
+	tcs := []struct {
+		name     string
+		trigger  *BuildTrigger
+		expected string
+	}{
+		{
+			name:    "unknown",
+			trigger: &BuildTrigger{Name: "t"},
+		},
+		{
+			name:     "github",
+			trigger:  &BuildTrigger{Name: "t", Github: &cloudbuild.GitHubEventsConfig{Owner: "acme", Name: "api"}},
+			expected: "https://github.com/acme/api",
+		},
+		{
+			name:     "cloud source repository",
+			trigger:  &BuildTrigger{Name: "t", TriggerTemplate: &cloudbuild.RepoSource{RepoName: "api"}},
+			expected: "https://source.developers.google.com/p/test-project/r/api",
+		},
+		{
+			name:     "cloud source repository of another project",
+			trigger:  &BuildTrigger{Name: "t", TriggerTemplate: &cloudbuild.RepoSource{ProjectId: "other", RepoName: "api"}},
+			expected: "https://source.developers.google.com/p/other/r/api",
+		},
+		{
+			name:     "source to build",
+			trigger:  &BuildTrigger{Name: "t", SourceToBuild: &cloudbuild.GitRepoSource{Uri: "https://gitlab.com/acme/api"}},
+			expected: "https://gitlab.com/acme/api",
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			if repository := triggerRepository("test-project", tc.trigger); repository != tc.expected {
+				t.Errorf("got repository %q, want %q", repository, tc.expected)
+			}
+		})
+	}
+}
+
+func TestBuildOutputs(t *testing.T) {
+	tcs := []struct {
+		name     string
+		build    *cloudbuild.Build
+		expected map[string]string
+	}{
+		{
+			name:     "nothing",
+			build:    &cloudbuild.Build{},
+			expected: map[string]string{},
+		},
+		{
+			name: "resolved commit",
+			build: &cloudbuild.Build{SourceProvenance: &cloudbuild.SourceProvenance{
+				ResolvedRepoSource: &cloudbuild.RepoSource{CommitSha: "0123456"},
+			}},
+			expected: map[string]string{"commit_sha": "0123456"},
+		},
+		{
+			name: "every output",
+			build: &cloudbuild.Build{
+				Substitutions: map[string]string{"REVISION_ID": "abcdef0"},
+				Artifacts: &cloudbuild.Artifacts{Objects: &cloudbuild.ArtifactObjects{
+					Location: "gs://bucket/app/",
+					Paths:    []string{"dist/app.tar.gz", "dist/*.sig"},
+				}},
+				Results: &cloudbuild.Results{
+					Images: []*cloudbuild.BuiltImage{
+						{Name: "gcr.io/p/api", Digest: "sha256:1"},
+						{Name: "gcr.io/p/worker", Digest: "sha256:2"},
+					},
+					// base64 of "v1.2.0\n", the second step writing no output.
+					BuildStepOutputs: []string{"djEuMi4wCg==", ""},
+					ArtifactManifest: "gs://bucket/app/artifacts-manifest.json",
+				},
+			},
+			expected: map[string]string{
+				"commit_sha":           "abcdef0",
+				"artifacts_location":   "gs://bucket/app/",
+				"artifacts.0.path":     "dist/app.tar.gz",
+				"artifacts.1.path":     "dist/*.sig",
+				"image":                "gcr.io/p/api",
+				"image_digest":         "sha256:1",
+				"images.0.name":        "gcr.io/p/api",
+				"images.0.digest":      "sha256:1",
+				"images.1.name":        "gcr.io/p/worker",
+				"images.1.digest":      "sha256:2",
+				"build_step_outputs.0": "v1.2.0",
+				"artifact_manifest":    "gs://bucket/app/artifacts-manifest.json",
+			},
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			if d := cmp.Diff(tc.expected, BuildOutputs(tc.build)); d != "" {
+				t.Errorf("unexpected outputs (-want, +got): %s", d)
+			}
+		})
+	}
+}
@@ -0,0 +1,292 @@
+package gcp
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	fakeCommitSha = "0123456789abcdef0123456789abcdef01234567"
+)
+
+// FakeOutcome scripts how a build started by the FakeBackend ends.
+type FakeOutcome struct {
+	// Status is the final status of the build, SUCCESS when empty.
+	Status string
+	// Duration is how long the build takes to end, QueuedDuration of which QUEUED
+	// and the rest WORKING.
+	Duration       time.Duration
+	QueuedDuration time.Duration
+	// Err makes RunTrigger fail instead of starting a build.
+	Err error
+	// Outputs are the outputs of the build, in addition to its commit_sha.
+	Outputs map[string]string
+}
+
+type fakeTrigger struct {
+	projectId string
+	region    string
+	trigger   *BuildTrigger
+}
+
+type fakeBuild struct {
+	projectId string
+	region    string
+	commitSha string
+	outcome   FakeOutcome
+	startTime time.Time
+	cancelled bool
+}
+
+// FakeBackend is an in-memory Backend with scriptable outcomes and durations.
+type FakeBackend struct {
+	lock      sync.Mutex
+	triggers  map[string]fakeTrigger
+	outcomes  map[string][]FakeOutcome
+	builds    map[string]*fakeBuild
+	runs      []string
+	sources   []RepoSource
+	cancelled []string
+	listErrs  map[string]error
+	denied    map[string]bool
+	permErrs  map[string]error
+	missing   map[string]bool
+	CommitSha string
+}
+
+func NewFakeBackend() *FakeBackend {
+	return &FakeBackend{
+		triggers:  map[string]fakeTrigger{},
+		outcomes:  map[string][]FakeOutcome{},
+		builds:    map[string]*fakeBuild{},
+		listErrs:  map[string]error{},
+		denied:    map[string]bool{},
+		permErrs:  map[string]error{},
+		missing:   map[string]bool{},
+		CommitSha: fakeCommitSha,
+	}
+}
+
+// AddTrigger registers a global trigger named name in the project projectId.
+func (f *FakeBackend) AddTrigger(projectId string, name string) *BuildTrigger {
+	return f.AddRegionalTrigger(projectId, GlobalRegion, name)
+}
+
+// AddRegionalTrigger registers a trigger named name in the region of the project projectId.
+func (f *FakeBackend) AddRegionalTrigger(projectId string, region string, name string) *BuildTrigger {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	trigger := &BuildTrigger{
+		Id:            "fake-" + name,
+		Name:          name,
+		Substitutions: map[string]string{},
+	}
+	f.triggers[TriggerKey(projectId, region, name)] = fakeTrigger{
+		projectId: projectId,
+		region:    normalizeRegion(region),
+		trigger:   trigger,
+	}
+	return trigger
+}
+
+// SetOutcomes scripts the successive builds of a global trigger, the last outcome
+// is reused once the others have been consumed.
+func (f *FakeBackend) SetOutcomes(projectId string, name string, outcomes ...FakeOutcome) {
+	f.SetRegionalOutcomes(projectId, GlobalRegion, name, outcomes...)
+}
+
+// SetRegionalOutcomes scripts the successive builds of a trigger of the region, see SetOutcomes.
+func (f *FakeBackend) SetRegionalOutcomes(projectId string, region string, name string, outcomes ...FakeOutcome) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.outcomes[TriggerKey(projectId, region, name)] = outcomes
+}
+
+// Runs returns the triggers run so far, by TriggerKey, in order.
+func (f *FakeBackend) Runs() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]string{}, f.runs...)
+}
+
+// Sources returns the sources the triggers were run with, in order.
+func (f *FakeBackend) Sources() []RepoSource {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]RepoSource{}, f.sources...)
+}
+
+// Cancelled returns the IDs of the builds cancelled so far, in order.
+func (f *FakeBackend) Cancelled() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]string{}, f.cancelled...)
+}
+
+// FailListing makes the listing of the triggers of the project fail with err.
+func (f *FakeBackend) FailListing(projectId string, err error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.listErrs[projectId] = err
+}
+
+// DenyPermission revokes the permission, granted by default, on the project.
+func (f *FakeBackend) DenyPermission(projectId string, permission string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.denied[projectId+"/"+permission] = true
+}
+
+// FailPermissionCheck makes the check of the permissions on the project fail with err.
+func (f *FakeBackend) FailPermissionCheck(projectId string, err error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.permErrs[projectId] = err
+}
+
+func (f *FakeBackend) HasPermission(projectId string, permission string) (bool, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.permErrs[projectId]; err != nil {
+		return false, err
+	}
+	return !f.denied[projectId+"/"+permission], nil
+}
+
+// DeleteBranch removes the branch, existing by default, from the repositories of the triggers.
+func (f *FakeBackend) DeleteBranch(branch string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.missing[branch] = true
+}
+
+func (f *FakeBackend) HasBranch(projectId string, trigger *BuildTrigger, branch string) (bool, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return !f.missing[branch], nil
+}
+
+func (f *FakeBackend) ListTriggers(projectId string, region string) (map[string]*BuildTrigger, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.listErrs[projectId]; err != nil {
+		return nil, err
+	}
+	buildTriggers := make(map[string]*BuildTrigger)
+	for key, t := range f.triggers {
+		if t.projectId == projectId && t.region == normalizeRegion(region) {
+			buildTriggers[key] = t.trigger
+		}
+	}
+	return buildTriggers, nil
+}
+
+func (f *FakeBackend) nextOutcome(key string) FakeOutcome {
+	outcomes := f.outcomes[key]
+	if len(outcomes) == 0 {
+		return FakeOutcome{Status: SUCCESS}
+	}
+	outcome := outcomes[0]
+	if len(outcomes) > 1 {
+		f.outcomes[key] = outcomes[1:]
+	}
+	if outcome.Status == "" {
+		outcome.Status = SUCCESS
+	}
+	return outcome
+}
+
+func (f *FakeBackend) RunTrigger(projectId string, region string, triggerId string, repoSource RepoSource) (*BuildOperation, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	var trigger *BuildTrigger
+	for _, t := range f.triggers {
+		if t.trigger.Id == triggerId && t.projectId == projectId && t.region == normalizeRegion(region) {
+			trigger = t.trigger
+		}
+	}
+	if trigger == nil {
+		return nil, fmt.Errorf("trigger %s not found in %s", triggerId, locationName(projectId, region))
+	}
+	key := TriggerKey(projectId, region, trigger.Name)
+	outcome := f.nextOutcome(key)
+	if outcome.Err != nil {
+		return nil, outcome.Err
+	}
+	f.runs = append(f.runs, key)
+	f.sources = append(f.sources, repoSource)
+	id := fmt.Sprintf("fake-build-%d", len(f.builds)+1)
+	commitSha := repoSource.CommitSha
+	if commitSha == "" {
+		commitSha = f.CommitSha
+	}
+	f.builds[id] = &fakeBuild{
+		projectId: projectId,
+		region:    normalizeRegion(region),
+		commitSha: commitSha,
+		outcome:   outcome,
+		startTime: time.Now(),
+	}
+	return &BuildOperation{
+		ID:        id,
+		LogURL:    "https://console.cloud.google.com/cloud-build/builds/" + id + "?project=" + projectId,
+		CommitSha: commitSha,
+	}, nil
+}
+
+func (f *FakeBackend) getBuild(projectId string, region string, buildId string) (*fakeBuild, error) {
+	build, ok := f.builds[buildId]
+	if !ok || build.projectId != projectId || build.region != normalizeRegion(region) {
+		return nil, errors.New("build " + buildId + " not found in " + locationName(projectId, region))
+	}
+	return build, nil
+}
+
+func (f *FakeBackend) GetBuild(projectId string, region string, buildId string) (string, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	build, err := f.getBuild(projectId, region, buildId)
+	if err != nil {
+		return "", err
+	}
+	if build.cancelled {
+		return CANCELLED, nil
+	}
+	if elapsed := time.Since(build.startTime); elapsed < build.outcome.QueuedDuration {
+		return QUEUED, nil
+	} else if elapsed < build.outcome.Duration {
+		return WORKING, nil
+	}
+	return build.outcome.Status, nil
+}
+
+func (f *FakeBackend) GetBuildOutputs(projectId string, region string, buildId string) (map[string]string, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	build, err := f.getBuild(projectId, region, buildId)
+	if err != nil {
+		return nil, err
+	}
+	outputs := map[string]string{"commit_sha": build.commitSha}
+	for key, value := range build.outcome.Outputs {
+		outputs[key] = value
+	}
+	return outputs, nil
+}
+
+func (f *FakeBackend) CancelBuild(projectId string, region string, buildId string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	build, err := f.getBuild(projectId, region, buildId)
+	if err != nil {
+		return err
+	}
+	if build.cancelled || time.Since(build.startTime) >= build.outcome.Duration {
+		return errors.New("build " + buildId + " has already finished")
+	}
+	build.cancelled = true
+	f.cancelled = append(f.cancelled, buildId)
+	return nil
+}
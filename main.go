@@ -4,15 +4,285 @@ import (
 	"cork/cmd"
 	"cork/config"
 	"cork/flow"
+	"cork/gcp"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"gopkg.in/yaml.v3"
 )
 
+// rehearsalBackend returns a fake backend whose triggers declare every substitution the
+// configs give, and whose builds succeed with placeholders for the outputs referenced.
+func rehearsalBackend(states []*flow.RunState) gcp.Backend {
+	backend := gcp.NewFakeBackend()
+	triggers := map[string]*gcp.BuildTrigger{}
+	outputs := map[string]map[string]string{}
+	for _, state := range states {
+		referenced := flow.ReferencedOutputs(state.Config, state.Substitutions)
+		for _, step := range state.Config.Steps {
+			key := state.Config.GetTriggerKey(step)
+			region := state.Config.GetRegion(step)
+			if triggers[key] == nil {
+				triggers[key] = backend.AddRegionalTrigger(step.ProjectId, region, step.Trigger)
+				outputs[key] = map[string]string{}
+			}
+			for _, substitutions := range []map[string]string{state.Config.Substitutions, step.Substitutions, state.Substitutions} {
+				for name := range substitutions {
+					triggers[key].Substitutions[name] = ""
+				}
+			}
+			for _, output := range referenced[step.Name] {
+				outputs[key][output] = "rehearsal-" + output
+			}
+			backend.SetRegionalOutcomes(step.ProjectId, region, step.Trigger, gcp.FakeOutcome{Outputs: outputs[key]})
+		}
+	}
+	return backend
+}
+
+// overrides returns the overrides of the configs given on the command line.
+func overrides(options cmd.Options) config.Overrides {
+	return config.Overrides{Vars: options.Vars, Profile: options.Profile}
+}
+
+// selection returns the selection of the steps given on the command line.
+func selection(options cmd.Options) (config.Selection, error) {
+	selection := config.Selection{
+		Included:       options.Included,
+		Excluded:       options.Excluded,
+		Only:           options.Only,
+		From:           options.From,
+		To:             options.To,
+		WithUpstream:   options.WithUpstream,
+		WithDownstream: options.WithDownstream,
+	}
+	if options.Select != "" {
+		selector, err := config.ParseSelector(options.Select)
+		if err != nil {
+			return selection, err
+		}
+		selection.Selector = selector
+	}
+	if options.Labels != "" {
+		labels, err := config.ParseLabelSelector(options.Labels)
+		if err != nil {
+			return selection, err
+		}
+		selection.Labels = labels
+	}
+	return selection, nil
+}
+
+// loadConfigs reads the config files given on the command line.
+func loadConfigs(options cmd.Options) ([]config.Config, error) {
+	configs := []config.Config{}
+	for _, filename := range options.Filenames {
+		c, err := config.Unmarshal(filename, overrides(options))
+		if err != nil {
+			return nil, err
+		}
+		configs = append(configs, c)
+	}
+	return configs, nil
+}
+
+func loadRunStates(options cmd.Options) ([]*flow.RunState, error) {
+	states := []*flow.RunState{}
+	if options.Command == cmd.ResumeCommand {
+		for _, filename := range options.Filenames {
+			state, err := flow.LoadRunState(filename, options.Rehearse)
+			if err != nil {
+				return nil, err
+			}
+			states = append(states, state)
+		}
+		return states, nil
+	}
+
+	configs, err := loadConfigs(options)
+	if err != nil {
+		return nil, err
+	}
+	selection, err := selection(options)
+	if err != nil {
+		return nil, err
+	}
+	if err := selection.Check(configs); err != nil {
+		return nil, err
+	}
+	// The configs are filtered together for the dependencies between them to be rewired.
+	filteredConfigs := config.Filter(configs, selection)
+	printSelection(configs, filteredConfigs)
+	for _, filteredConfig := range filteredConfigs {
+		state, err := flow.NewRunState(filteredConfig, options)
+		if err != nil {
+			return nil, err
+		}
+		states = append(states, state)
+	}
+	return states, nil
+}
+
+// printSelection prints the steps selected among the steps of the configs, with their
+// dependencies once filtered, when some of them are left out.
+func printSelection(configs []config.Config, filteredConfigs []config.Config) {
+	total, selected := 0, []string{}
+	leftOut := []string{}
+	for i, c := range configs {
+		kept := map[string]bool{}
+		for _, step := range filteredConfigs[i].Steps {
+			name := step.Name
+			if len(configs) > 1 {
+				name = c.Name + "/" + name
+			}
+			if len(step.DependsOn) > 0 {
+				name += " after " + strings.Join(step.DependsOn, ", ")
+			}
+			selected = append(selected, "\t"+name)
+			kept[step.Name] = true
+		}
+		for _, step := range c.Steps {
+			total++
+			if !kept[step.Name] {
+				name := step.Name
+				if len(configs) > 1 {
+					name = c.Name + "/" + name
+				}
+				leftOut = append(leftOut, name)
+			}
+		}
+	}
+	if len(leftOut) == 0 {
+		return
+	}
+	fmt.Printf("# selected steps, %d of %d:\n", len(selected), total)
+	if len(selected) > 0 {
+		fmt.Println(strings.Join(selected, "\n"))
+	}
+	fmt.Println("Left out: " + strings.Join(leftOut, ", "))
+}
+
+// validate prints the problems of the config files and returns the matching exit code.
+func validate(paths []string, overrides config.Overrides) int {
+	code := flow.ExitSuccess
+	invalid := map[string]bool{}
+	for _, problem := range config.Validate(paths, overrides) {
+		fmt.Println(problem)
+		invalid[problem.File] = true
+		code = flow.ExitOrchestrationError
+	}
+	for _, path := range paths {
+		if !invalid[path] {
+			fmt.Println(path + " is valid")
+		}
+	}
+	return code
+}
+
+// render prints the config files as run, with their includes, profile, templates and
+// variables resolved, and returns the matching exit code.
+func render(paths []string, overrides config.Overrides) int {
+	for i, path := range paths {
+		c, err := config.Unmarshal(path, overrides)
+		if err != nil {
+			log.Println(err)
+			return flow.ExitOrchestrationError
+		}
+		if i > 0 {
+			fmt.Println("---")
+		}
+		fmt.Println("# " + path)
+		encoder := yaml.NewEncoder(os.Stdout)
+		encoder.SetIndent(2)
+		if err := encoder.Encode(c); err != nil {
+			log.Println(err)
+			return flow.ExitOrchestrationError
+		}
+		encoder.Close()
+	}
+	return flow.ExitSuccess
+}
+
+// explain prints whether every step of the config files is selected and why, and returns
+// the matching exit code.
+func explain(options cmd.Options) int {
+	configs, err := loadConfigs(options)
+	if err != nil {
+		log.Println(err)
+		return flow.ExitOrchestrationError
+	}
+	selection, err := selection(options)
+	if err == nil {
+		err = selection.Check(configs)
+	}
+	if err != nil {
+		log.Println(err)
+		return flow.ExitOrchestrationError
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "STEP\tSELECTED\tWHY")
+	for _, explanation := range config.Explain(configs, selection) {
+		name := explanation.Step
+		if len(configs) > 1 {
+			name = explanation.Config + "/" + name
+		}
+		selected := "no"
+		if explanation.Selected {
+			selected = "yes"
+		}
+		why := "-"
+		if len(explanation.Reasons) > 0 {
+			why = strings.Join(explanation.Reasons, ", ")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", name, selected, why)
+	}
+	w.Flush()
+	return flow.ExitSuccess
+}
+
 func main() {
 
 	options := cmd.Parse()
+	switch options.Command {
+	case cmd.ValidateCommand:
+		os.Exit(validate(options.Filenames, overrides(options)))
+	case cmd.RenderCommand:
+		os.Exit(render(options.Filenames, overrides(options)))
+	case cmd.ExplainCommand:
+		os.Exit(explain(options))
+	case cmd.SchemaCommand:
+		schema, err := config.SchemaJSON()
+		if err != nil {
+			log.Println(err)
+			os.Exit(flow.ExitOrchestrationError)
+		}
+		os.Stdout.Write(schema)
+		os.Exit(flow.ExitSuccess)
+	}
 
-	c := config.Unmarshal(options.Filename)
+	states, err := loadRunStates(options)
+	if err != nil {
+		log.Println(err)
+		os.Exit(flow.ExitOrchestrationError)
+	}
 
-	filteredConfig := c.Filter(options.Included, options.Excluded)
+	var backend gcp.Backend
+	if options.Rehearse {
+		backend = rehearsalBackend(states)
+	} else {
+		cloudBuild, err := gcp.NewCloudBuild()
+		if err != nil {
+			log.Println(err)
+			os.Exit(flow.ExitOrchestrationError)
+		}
+		backend = cloudBuild
+	}
 
-	flow.Execute([]config.Config{filteredConfig}, options)
+	if options.DryRun {
+		os.Exit(flow.Plan(states, backend))
+	}
+	os.Exit(flow.Execute(states, options, backend))
 }
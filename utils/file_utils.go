@@ -0,0 +1,62 @@
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ExpandPaths returns the files designated by paths, in order and without duplicates:
+// a directory designates its YAML files and a glob pattern the files it matches.
+func ExpandPaths(paths []string) ([]string, error) {
+	files := []string{}
+	add := func(file string) {
+		if !Contains(files, file) {
+			files = append(files, file)
+		}
+	}
+	for _, path := range paths {
+		if strings.ContainsAny(path, "*?[") {
+			matches, err := filepath.Glob(path)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern %s: %w", path, err)
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("no file matches %s", path)
+			}
+			for _, match := range matches {
+				add(match)
+			}
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			add(path)
+			continue
+		}
+		entries, err := ioutil.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		dirFiles := []string{}
+		for _, entry := range entries {
+			if ext := filepath.Ext(entry.Name()); !entry.IsDir() && (ext == ".yaml" || ext == ".yml") {
+				dirFiles = append(dirFiles, filepath.Join(path, entry.Name()))
+			}
+		}
+		if len(dirFiles) == 0 {
+			return nil, fmt.Errorf("no YAML file in %s", path)
+		}
+		sort.Strings(dirFiles)
+		for _, file := range dirFiles {
+			add(file)
+		}
+	}
+	return files, nil
+}
@@ -0,0 +1,87 @@
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestExpandPaths(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"deploy/b.yaml", "deploy/a.yml", "deploy/notes.txt", "platform.yaml"} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte{}, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tcs := []struct {
+		name        string
+		paths       []string
+		expected    []string
+		expectedErr bool
+	}{
+		{
+			name:     "file",
+			paths:    []string{"platform.yaml"},
+			expected: []string{"platform.yaml"},
+		},
+		{
+			name:     "directory",
+			paths:    []string{"deploy"},
+			expected: []string{"deploy/a.yml", "deploy/b.yaml"},
+		},
+		{
+			name:     "glob",
+			paths:    []string{"deploy/*.yaml", "platform.yaml"},
+			expected: []string{"deploy/b.yaml", "platform.yaml"},
+		},
+		{
+			name:     "duplicates",
+			paths:    []string{"deploy/b.yaml", "deploy"},
+			expected: []string{"deploy/b.yaml", "deploy/a.yml"},
+		},
+		{
+			name:        "missing file",
+			paths:       []string{"missing.yaml"},
+			expectedErr: true,
+		},
+		{
+			name:        "glob without match",
+			paths:       []string{"*.json"},
+			expectedErr: true,
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			paths := []string{}
+			for _, path := range tc.paths {
+				paths = append(paths, filepath.Join(dir, path))
+			}
+			got, err := ExpandPaths(paths)
+			if tc.expectedErr {
+				if err == nil {
+					t.Errorf("expected an error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := []string{}
+			for _, path := range tc.expected {
+				expected = append(expected, filepath.Join(dir, path))
+			}
+			if d := cmp.Diff(expected, got); d != "" {
+				t.Errorf("unexpected files (-want, +got): %s", d)
+			}
+		})
+	}
+}